@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -18,14 +21,19 @@ var chainCmd = &cobra.Command{
 
 func init() {
 	chainCmd.Flags().StringArray("step", nil, `scan steps in "type:key=val,key=val" format`)
+	chainCmd.Flags().String("config", "", "YAML or JSON file declaring the chain steps and options")
 	chainCmd.Flags().Int("port-base", 30000, "base port for e2e SOCKS proxies")
-	chainCmd.MarkFlagRequired("step")
+	chainCmd.Flags().String("checkpoint", "", "periodically save progress to this file so the run can be resumed")
+	chainCmd.Flags().String("resume", "", "resume a run from a checkpoint file (keeps saving to it unless --checkpoint is set)")
+	chainCmd.MarkFlagsOneRequired("step", "config")
+	chainCmd.MarkFlagsMutuallyExclusive("step", "config")
 	rootCmd.AddCommand(chainCmd)
 }
 
 type stepConfig struct {
 	name   string
 	params map[string]string
+	line   int // position in the config file, 0 for --step
 }
 
 func parseStepFlag(raw string) (stepConfig, error) {
@@ -64,6 +72,15 @@ func buildStep(cfg stepConfig, defaultTimeout, defaultCount int, ports chan int,
 	}
 	dur := time.Duration(stepTimeout) * time.Second
 
+	var stepWorkers int
+	if v, ok := cfg.params["workers"]; ok {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 1 {
+			return scanner.Step{}, fmt.Errorf("step %q: invalid workers %q", cfg.name, v)
+		}
+		stepWorkers = w
+	}
+
 	stepCount := defaultCount
 	if v, ok := cfg.params["count"]; ok {
 		c, err := strconv.Atoi(v)
@@ -73,95 +90,446 @@ func buildStep(cfg stepConfig, defaultTimeout, defaultCount int, ports chan int,
 		stepCount = c
 	}
 
+	step, err := buildCheck(cfg, dur, stepCount, ports, ignoreRcodes)
+	if err != nil {
+		return scanner.Step{}, err
+	}
+	step.Workers = stepWorkers
+	if v, ok := cfg.params["sort"]; ok {
+		step.SortBy = v
+	}
+	step.Params = stepParams(cfg, stepTimeout, stepCount, ignoreRcodes)
+	return step, nil
+}
+
+// stepParams records what a step's results depend on: its own params and
+// the global settings it falls back to. workers is left out, so a resumed
+// run may use a different number.
+func stepParams(cfg stepConfig, timeout, count int, ignoreRcodes []int) map[string]string {
+	p := maps.Clone(cfg.params)
+	delete(p, "workers")
+	p["timeout"] = strconv.Itoa(timeout)
+	p["count"] = strconv.Itoa(count)
+	if _, ok := p["transport"]; !ok {
+		p["transport"] = transportName
+	}
+	if len(ignoreRcodes) > 0 {
+		p["ignore-rcode"] = strings.Join(ignoreRcodeNames, ",")
+	}
+	if bogonFile != "" {
+		p["bogon-file"] = bogonFile
+	}
+	if scanner.InsecureTLS {
+		p["insecure-tls"] = "true"
+	}
+	return p
+}
+
+// stepTransport returns the step's transport param, or --transport.
+func stepTransport(cfg stepConfig) (string, error) {
+	name := transportName
+	if v, ok := cfg.params["transport"]; ok {
+		name = v
+	}
+	t, err := scanner.ParseTransport(name)
+	if err != nil {
+		return "", fmt.Errorf("step %q: %w", cfg.name, err)
+	}
+	return t, nil
+}
+
+func buildCheck(cfg stepConfig, dur time.Duration, stepCount int, ports chan int, ignoreRcodes []int) (scanner.Step, error) {
 	switch cfg.name {
 	case "ping":
 		return scanner.Step{Name: "ping", Timeout: dur, Check: scanner.PingCheck(stepCount), SortBy: "ping_ms"}, nil
 
+	case "ping/tcp":
+		var port int
+		if v, ok := cfg.params["port"]; ok {
+			p, err := strconv.Atoi(v)
+			if err != nil || p < 1 || p > 65535 {
+				return scanner.Step{}, fmt.Errorf("step %q: invalid port %q", cfg.name, v)
+			}
+			port = p
+		}
+		return scanner.Step{Name: "ping/tcp", Timeout: dur, Check: scanner.TCPPingCheck(port, stepCount), SortBy: "ping_ms"}, nil
+
+	case "ping/udp":
+		return scanner.Step{Name: "ping/udp", Timeout: dur, Check: scanner.UDPPingCheck(stepCount), SortBy: "ping_ms"}, nil
+
 	case "resolve":
 		domain, ok := cfg.params["domain"]
 		if !ok || domain == "" {
 			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
 		}
-		return scanner.Step{Name: "resolve", Timeout: dur, Check: scanner.ResolveCheck(domain, stepCount, ignoreRcodes), SortBy: "resolve_ms"}, nil
+		qtypeName := "a"
+		if v, ok := cfg.params["qtype"]; ok {
+			qtypeName = v
+		}
+		qtype, err := scanner.ParseAddrType(qtypeName)
+		if err != nil {
+			return scanner.Step{}, fmt.Errorf("step %q: %w", cfg.name, err)
+		}
+		transport, err := stepTransport(cfg)
+		if err != nil {
+			return scanner.Step{}, err
+		}
+		return scanner.Step{Name: "resolve", Timeout: dur, Check: scanner.ResolveCheck(domain, qtype, transport, stepCount, ignoreRcodes), SortBy: "resolve_ms"}, nil
 
 	case "resolve/tunnel":
 		domain, ok := cfg.params["domain"]
 		if !ok || domain == "" {
 			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
 		}
-		return scanner.Step{Name: "resolve/tunnel", Timeout: dur, Check: scanner.TunnelCheck(domain, stepCount, ignoreRcodes), SortBy: "resolve_ms"}, nil
+		transport, err := stepTransport(cfg)
+		if err != nil {
+			return scanner.Step{}, err
+		}
+		return scanner.Step{Name: "resolve/tunnel", Timeout: dur, Check: scanner.TunnelCheck(domain, transport, stepCount, ignoreRcodes), SortBy: "resolve_ms"}, nil
 
-	case "e2e/dnstt":
+	case "resolve/inject":
 		domain, ok := cfg.params["domain"]
 		if !ok || domain == "" {
 			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
 		}
-		pubkey, ok := cfg.params["pubkey"]
-		if !ok || pubkey == "" {
-			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'pubkey'", cfg.name)
+		qtypeName := "a"
+		if v, ok := cfg.params["qtype"]; ok {
+			qtypeName = v
 		}
-		testURL := "https://httpbin.org/ip"
-		if v, ok := cfg.params["test-url"]; ok {
-			testURL = v
+		qtype, err := scanner.ParseAddrType(qtypeName)
+		if err != nil {
+			return scanner.Step{}, fmt.Errorf("step %q: %w", cfg.name, err)
 		}
-		socksUser := cfg.params["socks-user"]
-		socksPass := cfg.params["socks-pass"]
-		return scanner.Step{Name: "e2e/dnstt", Timeout: dur, Check: scanner.DnsttCheck(domain, pubkey, socksUser, socksPass, testURL, ports), SortBy: "e2e_ms"}, nil
+		window := 500
+		if v, ok := cfg.params["window"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return scanner.Step{}, fmt.Errorf("step %q: invalid window %q", cfg.name, v)
+			}
+			window = n
+		}
+		failInjected := false
+		if v, ok := cfg.params["fail-injected"]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return scanner.Step{}, fmt.Errorf("step %q: invalid fail-injected %q", cfg.name, v)
+			}
+			failInjected = b
+		}
+		expect, err := loadExpected(cfg.params["expect"], cfg.params["control"])
+		if err != nil {
+			return scanner.Step{}, fmt.Errorf("step %q: %w", cfg.name, err)
+		}
+		return scanner.Step{
+			Name:    "resolve/inject",
+			Timeout: dur,
+			Check:   scanner.InjectCheck(domain, qtype, expect, time.Duration(window)*time.Millisecond, failInjected),
+			SortBy:  "inject_ms",
+			Prepare: func(ctx context.Context) error {
+				return expect.QueryControl(ctx, domain, qtype, dur)
+			},
+		}, nil
 
-	case "e2e/slipstream":
+	case "resolve/payload":
 		domain, ok := cfg.params["domain"]
 		if !ok || domain == "" {
 			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
 		}
-		cert := cfg.params["cert"]
-		testURL := "https://httpbin.org/ip"
-		if v, ok := cfg.params["test-url"]; ok {
-			testURL = v
+		labelLen := 63
+		if v, ok := cfg.params["label-len"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 63 {
+				return scanner.Step{}, fmt.Errorf("step %q: invalid label-len %q", cfg.name, v)
+			}
+			labelLen = n
+		}
+		qtypeName := "txt"
+		if v, ok := cfg.params["qtype"]; ok {
+			qtypeName = v
+		}
+		qtype, err := scanner.ParseQtype(qtypeName)
+		if err != nil {
+			return scanner.Step{}, fmt.Errorf("step %q: %w", cfg.name, err)
+		}
+		minRatio := 0.8
+		if v, ok := cfg.params["min-ratio"]; ok {
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil || r < 0 || r > 1 {
+				return scanner.Step{}, fmt.Errorf("step %q: invalid min-ratio %q", cfg.name, v)
+			}
+			minRatio = r
+		}
+		var rate float64
+		if v, ok := cfg.params["rate"]; ok {
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil || r < 0 {
+				return scanner.Step{}, fmt.Errorf("step %q: invalid rate %q", cfg.name, v)
+			}
+			rate = r
+		}
+		if stepCount < 1 {
+			return scanner.Step{}, fmt.Errorf("step %q: invalid count %d", cfg.name, stepCount)
+		}
+		transport, err := stepTransport(cfg)
+		if err != nil {
+			return scanner.Step{}, err
 		}
-		return scanner.Step{Name: "e2e/slipstream", Timeout: dur, Check: scanner.SlipstreamCheck(domain, cert, testURL, ports), SortBy: "e2e_ms"}, nil
+		return scanner.Step{Name: "resolve/payload", Timeout: dur, Check: scanner.PayloadCheck(domain, labelLen, qtype, transport, stepCount, minRatio, rate), SortBy: "payload_ms"}, nil
+
+	case "probe/mtu":
+		domain, ok := cfg.params["domain"]
+		if !ok || domain == "" {
+			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
+		}
+		return scanner.Step{Name: "probe/mtu", Timeout: dur, Check: scanner.MTUCheck(domain), SortBy: "-max_response_bytes"}, nil
+
+	case "probe/echo":
+		domain, ok := cfg.params["domain"]
+		if !ok || domain == "" {
+			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
+		}
+		return scanner.Step{Name: "probe/echo", Timeout: dur, Check: scanner.EchoCheck(domain, []byte(cfg.params["secret"])), SortBy: "echo_ms"}, nil
+
+	case "probe/egress":
+		domain, ok := cfg.params["domain"]
+		if !ok || domain == "" {
+			return scanner.Step{}, fmt.Errorf("step %q: missing required param 'domain'", cfg.name)
+		}
+		if stepCount < 1 {
+			return scanner.Step{}, fmt.Errorf("step %q: invalid count %d", cfg.name, stepCount)
+		}
+		if v := cfg.params["query-log"]; v != "" {
+			if _, err := os.Stat(v); err != nil {
+				return scanner.Step{}, fmt.Errorf("step %q: %w", cfg.name, err)
+			}
+		}
+		return scanner.Step{Name: "probe/egress", Timeout: dur, Check: scanner.EgressCheck(domain, []byte(cfg.params["secret"]), stepCount), SortBy: "-egress_count"}, nil
 
 	default:
+		if client, ok := strings.CutPrefix(cfg.name, "e2e/"); ok {
+			return buildE2EStep(cfg, client, dur, ports)
+		}
 		return scanner.Step{}, fmt.Errorf("unknown step type %q", cfg.name)
 	}
 }
 
+// buildE2EStep builds an e2e/<client> or e2e/<client>-bench step for a
+// built-in or config-defined tunnel client.
+func buildE2EStep(cfg stepConfig, client string, dur time.Duration, ports chan int) (scanner.Step, error) {
+	name, bench := strings.CutSuffix(client, "-bench")
+	adapter, ok := scanner.LookupTunnelAdapter(name)
+	if !ok {
+		return scanner.Step{}, fmt.Errorf("unknown step type %q", cfg.name)
+	}
+	for _, p := range adapter.Params {
+		if cfg.params[p] == "" {
+			return scanner.Step{}, fmt.Errorf("step %q: missing required param '%s'", cfg.name, p)
+		}
+	}
+	embedded, err := embeddedParam(cfg)
+	if err != nil {
+		return scanner.Step{}, err
+	}
+	var dial scanner.DialSession
+	if embedded {
+		if adapter.Embedded == nil {
+			return scanner.Step{}, fmt.Errorf("step %q: %s has no embedded client", cfg.name, name)
+		}
+		if dial, err = adapter.Embedded(cfg.params); err != nil {
+			return scanner.Step{}, fmt.Errorf("step %q: %w", cfg.name, err)
+		}
+	}
+	tc := adapter.New(cfg.params)
+
+	// An in-process session always reaches a SOCKS5 proxy; a launched client
+	// says what its local proxy is.
+	proxyKind := scanner.ProxySOCKS5
+	if dial == nil {
+		proxyKind = tc.Proxy()
+	}
+	user, pass := cfg.params["socks-user"], cfg.params["socks-pass"]
+	if proxyKind == scanner.ProxyHTTP {
+		user, pass = cfg.params["proxy-user"], cfg.params["proxy-pass"]
+	}
+
+	if bench {
+		if proxyKind == scanner.ProxyNone {
+			return scanner.Step{}, fmt.Errorf("step %q: %s has no local proxy to bench through", cfg.name, name)
+		}
+		b, err := benchFromParams(cfg)
+		if err != nil {
+			return scanner.Step{}, err
+		}
+		check := scanner.ClientBenchCheck(tc, user, pass, b, ports)
+		if dial != nil {
+			check = scanner.SessionBenchCheck(dial, user, pass, b)
+		}
+		return scanner.Step{Name: cfg.name, Timeout: dur, Check: check, SortBy: "-down_kbps"}, nil
+	}
+
+	if proxyKind == scanner.ProxyNone {
+		// Only readiness can be checked: see ClientCheck
+		check := scanner.ClientCheck(tc, "", "", "", ports)
+		return scanner.Step{Name: cfg.name, Timeout: dur, Check: check, SortBy: "handshake_ms"}, nil
+	}
+	testURL := "https://httpbin.org/ip"
+	if v, ok := cfg.params["test-url"]; ok {
+		testURL = v
+	}
+	check := scanner.ClientCheck(tc, user, pass, testURL, ports)
+	if dial != nil {
+		check = scanner.SessionCheck(dial, user, pass, testURL)
+	}
+	return scanner.Step{Name: cfg.name, Timeout: dur, Check: check, SortBy: "e2e_ms"}, nil
+}
+
+// embeddedParam reads the "embedded" param, which asks for a tunnel client
+// to be run in process.
+func embeddedParam(cfg stepConfig) (bool, error) {
+	v, ok := cfg.params["embedded"]
+	if !ok {
+		return false, nil
+	}
+	embedded, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("step %q: invalid embedded %q", cfg.name, v)
+	}
+	return embedded, nil
+}
+
 func runChain(cmd *cobra.Command, args []string) error {
 	stepFlags, _ := cmd.Flags().GetStringArray("step")
+	configPath, _ := cmd.Flags().GetString("config")
+
+	// Parse all steps first (fail-fast)
+	var configs []stepConfig
+	if configPath != "" {
+		var err error
+		configs, err = loadChainConfig(configPath, cmd.Flags())
+		if err != nil {
+			return err
+		}
+	} else {
+		configs = make([]stepConfig, 0, len(stepFlags))
+		for _, raw := range stepFlags {
+			cfg, err := parseStepFlag(raw)
+			if err != nil {
+				return err
+			}
+			configs = append(configs, cfg)
+		}
+	}
+
+	// Read after the config file, which may have set them
 	portBase, _ := cmd.Flags().GetInt("port-base")
+	checkpointPath, _ := cmd.Flags().GetString("checkpoint")
+	resumePath, _ := cmd.Flags().GetString("resume")
 
 	ignoreRcodes, err := parseIgnoreRcodes()
 	if err != nil {
 		return err
 	}
 
-	// Parse all steps first (fail-fast)
-	configs := make([]stepConfig, 0, len(stepFlags))
-	for _, raw := range stepFlags {
-		cfg, err := parseStepFlag(raw)
-		if err != nil {
-			return err
+	// Shared port pool for e2e steps, sized for the busiest step
+	poolSize := workers
+	for _, cfg := range configs {
+		if w, err := strconv.Atoi(cfg.params["workers"]); err == nil && w > poolSize {
+			poolSize = w
 		}
-		configs = append(configs, cfg)
 	}
-
-	// Shared port pool for e2e steps
-	ports := scanner.PortPool(portBase, workers)
+	ports := scanner.PortPool(portBase, poolSize)
 
 	// Build all steps
 	steps := make([]scanner.Step, 0, len(configs))
 	for _, cfg := range configs {
 		s, err := buildStep(cfg, timeout, count, ports, ignoreRcodes)
 		if err != nil {
+			if cfg.line > 0 {
+				return &configError{configPath, cfg.line, err}
+			}
 			return err
 		}
 		steps = append(steps, s)
 	}
 
+	opts := scanner.ChainOptions{
+		NewProgress:    newProgressFactory(),
+		CheckpointPath: checkpointPath,
+	}
+
+	// Needed on resume too, in case the first step was not finished
 	ips, err := loadInput()
 	if err != nil {
 		return err
 	}
 
-	report := scanner.RunChain(ips, workers, steps, newProgressFactory())
+	// Egress IPs are grouped once the chain is done, over the resolvers
+	// that passed it
+	var egress *stepConfig
+	for i := range configs {
+		if configs[i].name == "probe/egress" {
+			egress = &configs[i]
+		}
+	}
+	started := time.Now()
+
+	if resumePath != "" {
+		cp, err := scanner.LoadCheckpoint(resumePath)
+		if err != nil {
+			return err
+		}
+		if err := cp.Matches(steps); err != nil {
+			return fmt.Errorf("cannot resume from %s: %w", resumePath, err)
+		}
+		opts.Resume = cp
+		started = cp.Started
+		if opts.CheckpointPath == "" {
+			opts.CheckpointPath = resumePath
+		}
+	}
+
+	format, err := outputFormat()
+	if err != nil {
+		return err
+	}
+	var ndjson *scanner.NDJSONWriter
+	if format == "ndjson" {
+		ndjson, err = scanner.NewNDJSONWriter(outputFile)
+		if err != nil {
+			return err
+		}
+		if egress == nil {
+			opts.OnRecord = ndjson.WriteRecord
+		}
+	}
+
+	report := scanner.RunChain(cmd.Context(), ips, workers, steps, opts)
+	if egress != nil {
+		r := scanner.Report{Passed: report.Passed, Failed: report.Failed}
+		post := groupEgress([]byte(egress.params["secret"]), egress.params["query-log"], started)
+		if err := post(&r); err != nil {
+			// Keep the results of the chain
+			fmt.Fprintf(os.Stderr, "egress: %v\n", err)
+		}
+		report.EgressGroups = r.EgressGroups
+	}
+	if ndjson != nil {
+		if opts.OnRecord == nil {
+			for _, rec := range report.Passed {
+				ndjson.WriteRecord(rec, true)
+			}
+			for _, rec := range report.Failed {
+				ndjson.WriteRecord(rec, false)
+			}
+		}
+		var secs float64
+		for _, sr := range report.Steps {
+			secs += sr.Seconds
+		}
+		return ndjson.Close(scanner.Summary{Seconds: secs, Steps: report.Steps, EgressGroups: report.EgressGroups, Interrupted: report.Interrupted})
+	}
+	if ok, err := writeTable(format, report.Passed, report.Failed); ok {
+		return err
+	}
 	return scanner.WriteChainReport(report, outputFile)
 }
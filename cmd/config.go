@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFlags are the global options a chain config file may set. Flags given
+// explicitly on the command line take precedence over the file.
+var configFlags = map[string]bool{
+	"workers":      true,
+	"timeout":      true,
+	"count":        true,
+	"port-base":    true,
+	"ignore-rcode": true,
+	"transport":    true,
+	"bogon-file":   true,
+	"checkpoint":   true,
+	"insecure-tls": true,
+}
+
+// configError carries the file position of a problem in a chain config.
+type configError struct {
+	path string
+	line int
+	err  error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.path, e.line, e.err)
+}
+
+func (e *configError) Unwrap() error { return e.err }
+
+// loadChainConfig reads a YAML (or JSON) chain config. Global options are
+// applied to flags that were not set on the command line; tunnel clients are
+// registered for e2e/<name> steps; the declared steps are returned in order.
+//
+//	workers: 100
+//	ignore-rcode: [nxdomain]
+//	clients:
+//	  dns2tcp:
+//	    command: dns2tcpc
+//	    args: ["-z", "{domain}", "-r", "socks", "-l", "{local-port}", "{ip}"]
+//	    params: [domain]
+//	steps:
+//	  - type: resolve
+//	    domain: google.com
+//	    workers: 200
+func loadChainConfig(path string, flags *pflag.FlagSet) ([]stepConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty config", path)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &configError{path, root.Line, fmt.Errorf("expected a mapping at top level")}
+	}
+
+	var configs []stepConfig
+	seen := make(map[string]bool)
+	for i := 0; i < len(root.Content); i += 2 {
+		key, val := root.Content[i], root.Content[i+1]
+		if seen[key.Value] {
+			return nil, &configError{path, key.Line, fmt.Errorf("duplicate key %q", key.Value)}
+		}
+		seen[key.Value] = true
+
+		switch {
+		case key.Value == "clients":
+			if err := parseConfigClients(path, val); err != nil {
+				return nil, err
+			}
+		case key.Value == "steps":
+			configs, err = parseConfigSteps(path, val)
+			if err != nil {
+				return nil, err
+			}
+		case configFlags[key.Value]:
+			if flags.Changed(key.Value) {
+				continue
+			}
+			v, err := scalarOrList(val)
+			if err != nil {
+				return nil, &configError{path, val.Line, fmt.Errorf("%s: %w", key.Value, err)}
+			}
+			if err := flags.Set(key.Value, v); err != nil {
+				return nil, &configError{path, val.Line, fmt.Errorf("%s: %w", key.Value, err)}
+			}
+		default:
+			return nil, &configError{path, key.Line, fmt.Errorf("unknown option %q", key.Value)}
+		}
+	}
+	if len(configs) == 0 {
+		return nil, &configError{path, root.Line, fmt.Errorf("no steps declared")}
+	}
+	return configs, nil
+}
+
+func parseConfigSteps(path string, node *yaml.Node) ([]stepConfig, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, &configError{path, node.Line, fmt.Errorf("steps: expected a list")}
+	}
+	configs := make([]stepConfig, 0, len(node.Content))
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return nil, &configError{path, item.Line, fmt.Errorf("step: expected a mapping with a 'type' key")}
+		}
+		cfg := stepConfig{params: make(map[string]string), line: item.Line}
+		for i := 0; i < len(item.Content); i += 2 {
+			key, val := item.Content[i], item.Content[i+1]
+			if val.Kind != yaml.ScalarNode {
+				return nil, &configError{path, val.Line, fmt.Errorf("param %q: expected a single value", key.Value)}
+			}
+			if key.Value == "type" {
+				cfg.name = val.Value
+				continue
+			}
+			if _, dup := cfg.params[key.Value]; dup {
+				return nil, &configError{path, key.Line, fmt.Errorf("duplicate param %q", key.Value)}
+			}
+			cfg.params[key.Value] = val.Value
+		}
+		if cfg.name == "" {
+			return nil, &configError{path, item.Line, fmt.Errorf("step: missing 'type'")}
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// parseConfigClients registers the tunnel clients declared under clients.
+func parseConfigClients(path string, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return &configError{path, node.Line, fmt.Errorf("clients: expected a mapping of client names")}
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		name, item := node.Content[i], node.Content[i+1]
+		if item.Kind != yaml.MappingNode {
+			return &configError{path, item.Line, fmt.Errorf("client %q: expected a mapping", name.Value)}
+		}
+		var command, proxy, ready string
+		var args, params []string
+		for j := 0; j < len(item.Content); j += 2 {
+			key, val := item.Content[j], item.Content[j+1]
+			var err error
+			switch key.Value {
+			case "command":
+				command, err = scalarValue(val)
+			case "proxy":
+				proxy, err = scalarValue(val)
+			case "ready":
+				ready, err = scalarValue(val)
+			case "args":
+				args, err = stringList(val)
+			case "params":
+				params, err = stringList(val)
+			default:
+				err = fmt.Errorf("unknown key")
+			}
+			if err != nil {
+				return &configError{path, key.Line, fmt.Errorf("client %q: %s: %w", name.Value, key.Value, err)}
+			}
+		}
+		adapter, err := scanner.NewCommandAdapter(command, args, params, proxy, ready)
+		if err == nil {
+			err = scanner.RegisterTunnelAdapter(name.Value, adapter)
+		}
+		if err != nil {
+			return &configError{path, name.Line, fmt.Errorf("client %q: %w", name.Value, err)}
+		}
+	}
+	return nil
+}
+
+func scalarValue(node *yaml.Node) (string, error) {
+	if node.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("expected a single value")
+	}
+	return node.Value, nil
+}
+
+func stringList(node *yaml.Node) ([]string, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("expected a list")
+	}
+	vals := make([]string, 0, len(node.Content))
+	for _, item := range node.Content {
+		if item.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("expected a list of values")
+		}
+		vals = append(vals, item.Value)
+	}
+	return vals, nil
+}
+
+func scalarOrList(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		vals := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("expected a list of values")
+			}
+			vals = append(vals, item.Value)
+		}
+		return strings.Join(vals, ","), nil
+	default:
+		return "", fmt.Errorf("expected a value or a list of values")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var e2eDnsttBenchCmd = &cobra.Command{
+	Use:   "dnstt-bench",
+	Short: "Measure throughput through a DNSTT SOCKS tunnel",
+	RunE:  runE2EDnsttBench,
+}
+
+var e2eSlipstreamBenchCmd = &cobra.Command{
+	Use:   "slipstream-bench",
+	Short: "Measure throughput through a Slipstream SOCKS tunnel",
+	RunE:  runE2ESlipstreamBench,
+}
+
+func init() {
+	e2eDnsttBenchCmd.Flags().String("domain", "", "DNSTT tunnel domain")
+	e2eDnsttBenchCmd.Flags().String("pubkey", "", "DNSTT server public key")
+	e2eDnsttBenchCmd.Flags().String("socks-user", "", "SOCKS5 proxy username")
+	e2eDnsttBenchCmd.Flags().String("socks-pass", "", "SOCKS5 proxy password")
+	e2eDnsttBenchCmd.Flags().Bool("embedded", false, "use the built-in dnstt client instead of dnstt-client")
+	addBenchFlags(e2eDnsttBenchCmd)
+	e2eDnsttBenchCmd.MarkFlagRequired("domain")
+	e2eDnsttBenchCmd.MarkFlagRequired("pubkey")
+	e2eCmd.AddCommand(e2eDnsttBenchCmd)
+
+	e2eSlipstreamBenchCmd.Flags().String("domain", "", "Slipstream tunnel domain")
+	e2eSlipstreamBenchCmd.Flags().String("cert", "", "path to Slipstream certificate for cert pinning (optional)")
+	addBenchFlags(e2eSlipstreamBenchCmd)
+	e2eSlipstreamBenchCmd.MarkFlagRequired("domain")
+	e2eCmd.AddCommand(e2eSlipstreamBenchCmd)
+}
+
+func addBenchFlags(cmd *cobra.Command) {
+	cmd.Flags().String("sink", "", "base URL of the server to download from and upload to, e.g. one run with serve --sink")
+	cmd.Flags().Int64("down-bytes", 256*1024, "bytes to download")
+	cmd.Flags().Int64("up-bytes", 64*1024, "bytes to upload (0 to skip)")
+	cmd.Flags().Int("max-time", 20, "seconds each direction may take before it is measured on what got through")
+	cmd.MarkFlagRequired("sink")
+}
+
+func benchFromFlags(cmd *cobra.Command) (scanner.Bench, error) {
+	sink, _ := cmd.Flags().GetString("sink")
+	down, _ := cmd.Flags().GetInt64("down-bytes")
+	up, _ := cmd.Flags().GetInt64("up-bytes")
+	maxTime, _ := cmd.Flags().GetInt("max-time")
+	return newBench(sink, down, up, maxTime)
+}
+
+// benchFromParams reads the bench options of a chain step, with the same
+// defaults as the flags.
+func benchFromParams(cfg stepConfig) (scanner.Bench, error) {
+	sink := cfg.params["sink"]
+	if sink == "" {
+		return scanner.Bench{}, fmt.Errorf("step %q: missing required param 'sink' (run serve --sink on a host you control)", cfg.name)
+	}
+	ints := map[string]int64{"down-bytes": 256 * 1024, "up-bytes": 64 * 1024, "max-time": 20}
+	for name := range ints {
+		if v, ok := cfg.params[name]; ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return scanner.Bench{}, fmt.Errorf("step %q: invalid %s %q", cfg.name, name, v)
+			}
+			ints[name] = n
+		}
+	}
+	b, err := newBench(sink, ints["down-bytes"], ints["up-bytes"], int(ints["max-time"]))
+	if err != nil {
+		return scanner.Bench{}, fmt.Errorf("step %q: %w", cfg.name, err)
+	}
+	return b, nil
+}
+
+func newBench(sink string, down, up int64, maxTime int) (scanner.Bench, error) {
+	if !strings.HasPrefix(sink, "http://") && !strings.HasPrefix(sink, "https://") {
+		return scanner.Bench{}, fmt.Errorf("invalid sink %q (must be an http:// or https:// URL)", sink)
+	}
+	if down < 1 {
+		return scanner.Bench{}, fmt.Errorf("invalid down-bytes %d", down)
+	}
+	if up < 0 {
+		return scanner.Bench{}, fmt.Errorf("invalid up-bytes %d", up)
+	}
+	if maxTime < 1 {
+		return scanner.Bench{}, fmt.Errorf("invalid max-time %d", maxTime)
+	}
+	return scanner.Bench{
+		Sink:      strings.TrimSuffix(sink, "/"),
+		DownBytes: down,
+		UpBytes:   up,
+		MaxTime:   time.Duration(maxTime) * time.Second,
+	}, nil
+}
+
+func runE2EDnsttBench(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	pubkey, _ := cmd.Flags().GetString("pubkey")
+	socksUser, _ := cmd.Flags().GetString("socks-user")
+	socksPass, _ := cmd.Flags().GetString("socks-pass")
+	embedded, _ := cmd.Flags().GetBool("embedded")
+	bench, err := benchFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(e2eTimeout) * time.Second
+	var check scanner.CheckFunc
+	if embedded {
+		key, err := scanner.ParseDnsttPubkey(pubkey)
+		if err != nil {
+			return err
+		}
+		check = scanner.SessionBenchCheck(scanner.DnsttSession(domain, key), socksUser, socksPass, bench)
+	} else {
+		ports := scanner.PortPool(30000, workers)
+		check = scanner.ClientBenchCheck(scanner.DnsttClient{Domain: domain, Pubkey: pubkey}, socksUser, socksPass, bench, ports)
+	}
+
+	return runScan(cmd, "e2e/dnstt-bench", ips, dur, check, "-down_kbps", nil)
+}
+
+func runE2ESlipstreamBench(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	certPath, _ := cmd.Flags().GetString("cert")
+	bench, err := benchFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(e2eTimeout) * time.Second
+	ports := scanner.PortPool(30000, workers)
+	check := scanner.ClientBenchCheck(scanner.SlipstreamClient{Domain: domain, Cert: certPath}, "", "", bench, ports)
+
+	return runScan(cmd, "e2e/slipstream-bench", ips, dur, check, "-down_kbps", nil)
+}
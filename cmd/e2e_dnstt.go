@@ -19,6 +19,7 @@ func init() {
 	e2eDnsttCmd.Flags().String("socks-user", "", "SOCKS5 proxy username")
 	e2eDnsttCmd.Flags().String("socks-pass", "", "SOCKS5 proxy password")
 	e2eDnsttCmd.Flags().String("test-url", "https://httpbin.org/ip", "URL to fetch through tunnel")
+	e2eDnsttCmd.Flags().Bool("embedded", false, "use the built-in dnstt client instead of dnstt-client")
 	e2eDnsttCmd.MarkFlagRequired("domain")
 	e2eDnsttCmd.MarkFlagRequired("pubkey")
 	e2eCmd.AddCommand(e2eDnsttCmd)
@@ -30,6 +31,7 @@ func runE2EDnstt(cmd *cobra.Command, args []string) error {
 	socksUser, _ := cmd.Flags().GetString("socks-user")
 	socksPass, _ := cmd.Flags().GetString("socks-pass")
 	testURL, _ := cmd.Flags().GetString("test-url")
+	embedded, _ := cmd.Flags().GetBool("embedded")
 
 	ips, err := loadInput()
 	if err != nil {
@@ -37,12 +39,17 @@ func runE2EDnstt(cmd *cobra.Command, args []string) error {
 	}
 
 	dur := time.Duration(e2eTimeout) * time.Second
-	ports := scanner.PortPool(30000, workers)
-	check := scanner.DnsttCheck(domain, pubkey, socksUser, socksPass, testURL, ports)
-
-	start := time.Now()
-	results := scanner.RunPool(ips, workers, dur, check, newProgress("e2e/dnstt"))
-	elapsed := time.Since(start)
+	var check scanner.CheckFunc
+	if embedded {
+		key, err := scanner.ParseDnsttPubkey(pubkey)
+		if err != nil {
+			return err
+		}
+		check = scanner.SessionCheck(scanner.DnsttSession(domain, key), socksUser, socksPass, testURL)
+	} else {
+		ports := scanner.PortPool(30000, workers)
+		check = scanner.ClientCheck(scanner.DnsttClient{Domain: domain, Pubkey: pubkey}, socksUser, socksPass, testURL, ports)
+	}
 
-	return writeReport("e2e/dnstt", results, elapsed, "e2e_ms")
+	return runScan(cmd, "e2e/dnstt", ips, dur, check, "e2e_ms", nil)
 }
@@ -33,11 +33,7 @@ func runE2ESlipstream(cmd *cobra.Command, args []string) error {
 
 	dur := time.Duration(e2eTimeout) * time.Second
 	ports := scanner.PortPool(30000, workers)
-	check := scanner.SlipstreamCheck(domain, certPath, testURL, ports)
+	check := scanner.ClientCheck(scanner.SlipstreamClient{Domain: domain, Cert: certPath}, "", "", testURL, ports)
 
-	start := time.Now()
-	results := scanner.RunPool(ips, workers, dur, check, newProgress("e2e/slipstream"))
-	elapsed := time.Since(start)
-
-	return writeReport("e2e/slipstream", results, elapsed, "e2e_ms")
+	return runScan(cmd, "e2e/slipstream", ips, dur, check, "e2e_ms", nil)
 }
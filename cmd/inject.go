@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var injectCmd = &cobra.Command{
+	Use:   "inject",
+	Short: "Detect DNS injection on the path to each resolver",
+	RunE:  runInject,
+}
+
+func init() {
+	injectCmd.Flags().String("domain", "", "domain to query, typically one that is censored")
+	injectCmd.Flags().String("qtype", "a", "address record type to query: a or aaaa")
+	injectCmd.Flags().String("expect", "", "file of IPs, CIDRs or ranges the domain legitimately resolves to")
+	injectCmd.Flags().String("control", "", "trusted resolver to take the expected answer from, queried over TCP")
+	injectCmd.Flags().Int("window", 500, "milliseconds to keep reading replies after the first one")
+	injectCmd.Flags().Bool("fail-injected", false, "fail resolvers with injection evidence instead of flagging them")
+	injectCmd.MarkFlagRequired("domain")
+	resolveCmd.AddCommand(injectCmd)
+}
+
+func runInject(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	qtypeName, _ := cmd.Flags().GetString("qtype")
+	expectFile, _ := cmd.Flags().GetString("expect")
+	control, _ := cmd.Flags().GetString("control")
+	window, _ := cmd.Flags().GetInt("window")
+	failInjected, _ := cmd.Flags().GetBool("fail-injected")
+
+	qtype, err := scanner.ParseAddrType(qtypeName)
+	if err != nil {
+		return err
+	}
+	if window < 0 {
+		return fmt.Errorf("invalid --window %d", window)
+	}
+	expect, err := loadExpected(expectFile, control)
+	if err != nil {
+		return err
+	}
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	if err := expect.QueryControl(cmd.Context(), domain, qtype, dur); err != nil {
+		return err
+	}
+	check := scanner.InjectCheck(domain, qtype, expect, time.Duration(window)*time.Millisecond, failInjected)
+
+	return runScan(cmd, "resolve/inject", ips, dur, check, "inject_ms", nil)
+}
+
+// loadExpected builds the expected answer set for injection checks from an
+// --expect file and a --control resolver, either of which may be empty.
+func loadExpected(expectFile, control string) (*scanner.Expected, error) {
+	expect := &scanner.Expected{}
+	if expectFile != "" {
+		addrs, err := scanner.LoadInput(expectFile, false)
+		if err != nil {
+			return nil, err
+		}
+		expect.Addrs = addrs
+	}
+	if control != "" {
+		expect.Control = scanner.ControlAddr(control)
+	}
+	return expect, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var payloadCmd = &cobra.Command{
+	Use:   "payload",
+	Short: "Test if resolvers carry dnstt-shaped queries to the tunnel server",
+	RunE:  runPayload,
+}
+
+func init() {
+	payloadCmd.Flags().String("domain", "", "tunnel domain to test")
+	payloadCmd.Flags().Int("label-len", 63, "length of each random base32 label (1-63)")
+	payloadCmd.Flags().String("qtype", "txt", "query type to send, e.g. txt or null")
+	payloadCmd.Flags().Float64("min-ratio", 0.8, "fraction of queries that must be answered to pass")
+	payloadCmd.Flags().Float64("rate", 0, "queries per second to send without waiting for replies (0 sends them one after another)")
+	payloadCmd.MarkFlagRequired("domain")
+	resolveCmd.AddCommand(payloadCmd)
+}
+
+func runPayload(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	labelLen, _ := cmd.Flags().GetInt("label-len")
+	qtypeName, _ := cmd.Flags().GetString("qtype")
+	minRatio, _ := cmd.Flags().GetFloat64("min-ratio")
+	rate, _ := cmd.Flags().GetFloat64("rate")
+
+	if labelLen < 1 || labelLen > 63 {
+		return fmt.Errorf("invalid --label-len %d (must be 1-63)", labelLen)
+	}
+	if minRatio < 0 || minRatio > 1 {
+		return fmt.Errorf("invalid --min-ratio %v (must be 0-1)", minRatio)
+	}
+	if rate < 0 {
+		return fmt.Errorf("invalid --rate %v", rate)
+	}
+	if count < 1 {
+		return fmt.Errorf("invalid --count %d", count)
+	}
+	qtype, err := scanner.ParseQtype(qtypeName)
+	if err != nil {
+		return err
+	}
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	transport, err := scanner.ParseTransport(transportName)
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.PayloadCheck(domain, labelLen, qtype, transport, count, minRatio, rate)
+
+	return runScan(cmd, "resolve/payload", ips, dur, check, "payload_ms", nil)
+}
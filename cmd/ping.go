@@ -26,9 +26,5 @@ func runPing(cmd *cobra.Command, args []string) error {
 	dur := time.Duration(timeout) * time.Second
 	check := scanner.PingCheck(count)
 
-	start := time.Now()
-	results := scanner.RunPool(ips, workers, dur, check, newProgress("ping"))
-	elapsed := time.Since(start)
-
-	return writeReport("ping", results, elapsed, "ping_ms")
+	return runScan(cmd, "ping", ips, dur, check, "ping_ms", nil)
 }
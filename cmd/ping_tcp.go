@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var pingTCPCmd = &cobra.Command{
+	Use:   "tcp",
+	Short: "Check reachability via TCP connect to the DNS port",
+	RunE:  runPingTCP,
+}
+
+func init() {
+	pingTCPCmd.Flags().Int("port", 0, "TCP port to connect to, e.g. 853 for DoT (default: each resolver's DNS port)")
+	pingCmd.AddCommand(pingTCPCmd)
+}
+
+func runPingTCP(cmd *cobra.Command, args []string) error {
+	port, _ := cmd.Flags().GetInt("port")
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.TCPPingCheck(port, count)
+
+	return runScan(cmd, "ping/tcp", ips, dur, check, "ping_ms", nil)
+}
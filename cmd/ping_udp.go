@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var pingUDPCmd = &cobra.Command{
+	Use:   "udp",
+	Short: "Check reachability via a minimal DNS query (any reply counts)",
+	RunE:  runPingUDP,
+}
+
+func init() {
+	pingCmd.AddCommand(pingUDPCmd)
+}
+
+func runPingUDP(cmd *cobra.Command, args []string) error {
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.UDPPingCheck(count)
+
+	return runScan(cmd, "ping/udp", ips, dur, check, "ping_ms", nil)
+}
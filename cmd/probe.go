@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Measure resolver properties that affect tunnel performance",
+}
+
+var probeMTUCmd = &cobra.Command{
+	Use:   "mtu",
+	Short: "Find the largest query name and response a resolver carries",
+	RunE:  runProbeMTU,
+}
+
+var probeEchoCmd = &cobra.Command{
+	Use:   "echo",
+	Short: "Check that resolvers deliver answers from our serve instance unmodified",
+	RunE:  runProbeEcho,
+}
+
+var probeEgressCmd = &cobra.Command{
+	Use:   "egress",
+	Short: "Map the egress IPs resolvers reach our serve instance from",
+	RunE:  runProbeEgress,
+}
+
+func init() {
+	probeEgressCmd.Flags().String("domain", "", "zone served by dnst-scanner serve")
+	probeEgressCmd.Flags().String("secret", "", "secret shared with the server, used to sign answers and tag queries")
+	probeEgressCmd.Flags().String("query-log", "", "query log written by serve --log, to correlate with the scanned resolvers")
+	probeEgressCmd.MarkFlagRequired("domain")
+	probeCmd.AddCommand(probeEgressCmd)
+
+	probeEchoCmd.Flags().String("domain", "", "zone served by dnst-scanner serve")
+	probeEchoCmd.Flags().String("secret", "", "secret the server signs echo answers with")
+	probeEchoCmd.MarkFlagRequired("domain")
+	probeCmd.AddCommand(probeEchoCmd)
+
+	probeMTUCmd.Flags().String("domain", "", "tunnel domain to probe")
+	probeMTUCmd.Flags().String("sort", "-max_response_bytes", "metric to sort passed resolvers by (prefix - for descending)")
+	probeMTUCmd.MarkFlagRequired("domain")
+	probeCmd.AddCommand(probeMTUCmd)
+	rootCmd.AddCommand(probeCmd)
+}
+
+func runProbeMTU(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	sortBy, _ := cmd.Flags().GetString("sort")
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.MTUCheck(domain)
+
+	return runScan(cmd, "probe/mtu", ips, dur, check, sortBy, nil)
+}
+
+func runProbeEcho(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	secret, _ := cmd.Flags().GetString("secret")
+
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.EchoCheck(domain, []byte(secret))
+
+	return runScan(cmd, "probe/echo", ips, dur, check, "echo_ms", nil)
+}
+
+func runProbeEgress(cmd *cobra.Command, args []string) error {
+	domain, _ := cmd.Flags().GetString("domain")
+	secret, _ := cmd.Flags().GetString("secret")
+	queryLog, _ := cmd.Flags().GetString("query-log")
+
+	if count < 1 {
+		return fmt.Errorf("invalid --count %d", count)
+	}
+	ips, err := loadInput()
+	if err != nil {
+		return err
+	}
+
+	if queryLog != "" {
+		// Fail now rather than after the scan
+		if _, err := os.Stat(queryLog); err != nil {
+			return err
+		}
+	}
+
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.EgressCheck(domain, []byte(secret), count)
+	post := groupEgress([]byte(secret), queryLog, time.Now())
+	return runScan(cmd, "probe/egress", ips, dur, check, "-egress_count", post)
+}
+
+// groupEgress returns the pass that completes egress probing once a scan is
+// done: it adds the egress IPs found in the query log, if any, and groups
+// the resolvers that share them. Log entries from before start, allowing for
+// clock skew between this host and the server's, are not counted.
+func groupEgress(secret []byte, queryLog string, start time.Time) func(*scanner.Report) error {
+	return func(report *scanner.Report) error {
+		if queryLog != "" {
+			since := start.Add(-time.Minute)
+			if err := scanner.CorrelateEgress(report.Passed, secret, queryLog, since); err != nil {
+				return err
+			}
+		}
+		report.EgressGroups = scanner.GroupEgress(report.Passed)
+		if len(report.EgressGroups) > 0 {
+			shared := 0
+			for _, g := range report.EgressGroups {
+				shared += len(g.Resolvers)
+			}
+			fmt.Fprintf(os.Stderr, "egress: %d resolvers share backends in %d groups\n", shared, len(report.EgressGroups))
+		}
+		return nil
+	}
+}
@@ -15,12 +15,18 @@ var resolveCmd = &cobra.Command{
 
 func init() {
 	resolveCmd.Flags().String("domain", "", "domain to test")
+	resolveCmd.Flags().String("qtype", "a", "address record type to query: a or aaaa")
 	resolveCmd.MarkFlagRequired("domain")
 	rootCmd.AddCommand(resolveCmd)
 }
 
 func runResolve(cmd *cobra.Command, args []string) error {
 	domain, _ := cmd.Flags().GetString("domain")
+	qtypeName, _ := cmd.Flags().GetString("qtype")
+	qtype, err := scanner.ParseAddrType(qtypeName)
+	if err != nil {
+		return err
+	}
 
 	ips, err := loadInput()
 	if err != nil {
@@ -32,12 +38,13 @@ func runResolve(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	dur := time.Duration(timeout) * time.Second
-	check := scanner.ResolveCheck(domain, count, ignoreRcodes)
+	transport, err := scanner.ParseTransport(transportName)
+	if err != nil {
+		return err
+	}
 
-	start := time.Now()
-	results := scanner.RunPool(ips, workers, dur, check, newProgress("resolve"))
-	elapsed := time.Since(start)
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.ResolveCheck(domain, qtype, transport, count, ignoreRcodes)
 
-	return writeReport("resolve", results, elapsed, "resolve_ms")
+	return runScan(cmd, "resolve", ips, dur, check, "resolve_ms", nil)
 }
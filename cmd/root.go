@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/net2share/dnst-scanner/internal/scanner"
@@ -17,6 +22,10 @@ var (
 	timeout          int
 	count            int
 	ignoreRcodeNames []string
+	outputFormatName string
+	excludeFile      string
+	transportName    string
+	bogonFile        string
 )
 
 var rootCmd = &cobra.Command{
@@ -26,20 +35,36 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
-	rootCmd.PersistentFlags().StringVarP(&inputFile, "input", "i", "", "input file (text or JSON)")
-	rootCmd.PersistentFlags().StringVarP(&outputFile, "output", "o", "", "output JSON file")
+	rootCmd.PersistentFlags().StringVarP(&inputFile, "input", "i", "", "input file (text, JSON or NDJSON)")
+	rootCmd.PersistentFlags().StringVar(&excludeFile, "exclude", "", "text file of IPs, CIDRs or ranges to leave out of the input")
+	rootCmd.PersistentFlags().StringVarP(&outputFile, "output", "o", "", "output file")
+	rootCmd.PersistentFlags().StringVar(&outputFormatName, "output-format", "", "output format: json or ndjson (default from --output extension, else json)")
 	rootCmd.PersistentFlags().BoolVar(&includeFailed, "include-failed", false, "also scan failed IPs from JSON input")
 	rootCmd.PersistentFlags().IntVar(&workers, "workers", 50, "concurrent workers")
 	rootCmd.PersistentFlags().IntVarP(&timeout, "timeout", "t", 3, "timeout per attempt in seconds")
 	rootCmd.PersistentFlags().IntVarP(&count, "count", "c", 3, "number of attempts per IP for ping/resolve checks")
+	rootCmd.PersistentFlags().StringVar(&transportName, "transport", "udp", "DNS transport for resolve checks: udp, tcp or both")
+	rootCmd.PersistentFlags().StringVar(&bogonFile, "bogon-file", "", "file of sinkhole IPs or CIDRs, with optional labels, to treat as bogus answers")
+	rootCmd.PersistentFlags().BoolVar(&scanner.InsecureTLS, "insecure-tls", false, "query DoH/DoT resolvers even if their certificate does not verify")
 	rootCmd.PersistentFlags().StringSliceVar(&ignoreRcodeNames, "ignore-rcode", nil, "DNS rcodes to ignore, e.g. nxdomain, servfail, refused, formerr (repeatable)")
-	rootCmd.MarkPersistentFlagRequired("input")
-	rootCmd.MarkPersistentFlagRequired("output")
 	rootCmd.SilenceUsage = true
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		// Restore default handling so a second signal aborts immediately
+		signal.Stop(sigs)
+		fmt.Fprint(os.Stderr, "\r\033[2Kinterrupted, writing partial results (signal again to abort)\n")
+		cancel()
+	}()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		os.Exit(1)
 	}
 }
@@ -59,18 +84,112 @@ func parseIgnoreRcodes() ([]int, error) {
 	return codes, nil
 }
 
-func loadInput() ([]string, error) {
+// loadInput reads --input minus --exclude. Every command that calls it also
+// writes --output, so both are checked here rather than marked required on
+// the root command, which serve shares.
+func loadInput() (*scanner.Input, error) {
+	var missing []string
+	for _, f := range []struct{ name, value string }{{"input", inputFile}, {"output", outputFile}} {
+		if f.value == "" {
+			missing = append(missing, `"`+f.name+`"`)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("required flag(s) %s not set", strings.Join(missing, ", "))
+	}
+
 	ips, err := scanner.LoadInput(inputFile, includeFailed)
 	if err != nil {
 		return nil, err
 	}
-	if len(ips) == 0 {
+	if excludeFile != "" {
+		ex, err := scanner.LoadInput(excludeFile, false)
+		if err != nil {
+			return nil, err
+		}
+		before := ips.Len()
+		ips.Exclude(ex)
+		if n := before - ips.Len(); n > 0 {
+			fmt.Fprintf(os.Stderr, "input: excluded %d addresses\n", n)
+		}
+	}
+	if ips.Len() == 0 {
 		return nil, fmt.Errorf("no resolvers found in %s", inputFile)
 	}
+	if bogonFile != "" {
+		if err := scanner.LoadBogons(bogonFile); err != nil {
+			return nil, err
+		}
+	}
 	return ips, nil
 }
 
-func writeReport(mode string, results []scanner.Result, elapsed time.Duration, sortBy string) error {
+// outputFormat returns the format selected by --output-format, falling back
+// to the extension of --output.
+func outputFormat() (string, error) {
+	switch strings.ToLower(outputFormatName) {
+	case "json", "ndjson", "csv", "tsv":
+		return strings.ToLower(outputFormatName), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown output format %q (supported: json, ndjson, csv, tsv)", outputFormatName)
+	}
+	switch strings.ToLower(filepath.Ext(outputFile)) {
+	case ".ndjson", ".jsonl":
+		return "ndjson", nil
+	case ".csv":
+		return "csv", nil
+	case ".tsv":
+		return "tsv", nil
+	}
+	return "json", nil
+}
+
+// writeTable writes passed and failed records as CSV or TSV, or returns false
+// if format is not a tabular one.
+func writeTable(format string, passed, failed []scanner.IPRecord) (bool, error) {
+	switch format {
+	case "csv":
+		return true, scanner.WriteTable(passed, failed, outputFile, ',')
+	case "tsv":
+		return true, scanner.WriteTable(passed, failed, outputFile, '\t')
+	}
+	return false, nil
+}
+
+// runScan runs a single check over ips and writes the report. With NDJSON
+// output, results are streamed to the file as they arrive instead of being
+// collected, unless post is set: post runs over the finished report before it
+// is written, for what only the whole scan shows.
+func runScan(cmd *cobra.Command, mode string, ips scanner.Targets, dur time.Duration, check scanner.CheckFunc, sortBy string, post func(*scanner.Report) error) error {
+	format, err := outputFormat()
+	if err != nil {
+		return err
+	}
+	ctx := cmd.Context()
+
+	if format == "ndjson" && post == nil {
+		w, err := scanner.NewNDJSONWriter(outputFile)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		scanner.RunPool(ctx, ips, workers, dur, check, newProgress(mode), w.WriteResult)
+		elapsed := time.Since(start)
+
+		passed, failed := w.Counts()
+		err = w.Close(scanner.Summary{Seconds: elapsed.Seconds(), Interrupted: ctx.Err() != nil})
+		if err != nil {
+			return err
+		}
+		scanner.PrintStats(mode, passed, failed, elapsed)
+		return nil
+	}
+
+	start := time.Now()
+	results := scanner.RunPool(ctx, ips, workers, dur, check, newProgress(mode), nil)
+	elapsed := time.Since(start)
+
 	// Sort passed results by metric before writing
 	passed := make([]scanner.Result, 0, len(results))
 	failed := make([]scanner.Result, 0)
@@ -84,12 +203,41 @@ func writeReport(mode string, results []scanner.Result, elapsed time.Duration, s
 	if sortBy != "" {
 		scanner.SortByMetric(passed, sortBy)
 	}
-	sorted := append(passed, failed...)
+	report := scanner.NewReport(append(passed, failed...))
+	if post != nil {
+		if err := post(&report); err != nil {
+			return err
+		}
+		if sortBy != "" {
+			scanner.SortRecords(report.Passed, sortBy)
+		}
+	}
 
-	if err := scanner.WriteReport(sorted, outputFile); err != nil {
-		return err
+	if format == "ndjson" {
+		w, err := scanner.NewNDJSONWriter(outputFile)
+		if err != nil {
+			return err
+		}
+		for _, rec := range report.Passed {
+			w.WriteRecord(rec, true)
+		}
+		for _, rec := range report.Failed {
+			w.WriteRecord(rec, false)
+		}
+		err = w.Close(scanner.Summary{Seconds: elapsed.Seconds(), EgressGroups: report.EgressGroups, Interrupted: ctx.Err() != nil})
+		if err != nil {
+			return err
+		}
+	} else {
+		ok, err := writeTable(format, report.Passed, report.Failed)
+		if !ok {
+			err = scanner.WriteReport(report, outputFile)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	scanner.PrintStats(mode, results, elapsed)
+	scanner.PrintStats(mode, len(passed), len(failed), elapsed)
 	return nil
 }
 
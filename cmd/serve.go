@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/net2share/dnst-scanner/internal/scanner"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run an authoritative DNS server for a test zone that probes can verify",
+	Long: `Run an authoritative DNS server for a test zone. Delegate a subdomain to the
+host running it, then point probe echo and probe mtu at that subdomain.`,
+	RunE: runServe,
+}
+
+func init() {
+	serveCmd.Flags().String("zone", "", "zone to serve, e.g. t.example.com")
+	serveCmd.Flags().String("listen", ":53", "address to listen on (UDP and TCP)")
+	serveCmd.Flags().StringSlice("ns", nil, "NS host names to return for the zone apex (repeatable)")
+	serveCmd.Flags().String("secret", "", "secret to sign echo answers with")
+	serveCmd.Flags().String("log", "", "file to append an NDJSON query log to")
+	serveCmd.Flags().String("sink", "", "also serve the e2e bench endpoints over HTTP on this address, e.g. :8080")
+	serveCmd.MarkFlagRequired("zone")
+	rootCmd.AddCommand(serveCmd)
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	zone, _ := cmd.Flags().GetString("zone")
+	listen, _ := cmd.Flags().GetString("listen")
+	ns, _ := cmd.Flags().GetStringSlice("ns")
+	secret, _ := cmd.Flags().GetString("secret")
+	logFile, _ := cmd.Flags().GetString("log")
+	sink, _ := cmd.Flags().GetString("sink")
+
+	var log io.Writer
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		log = f
+	}
+
+	ctx, cancel := context.WithCancel(cmd.Context())
+	defer cancel()
+	errs := make(chan error, 1)
+	if sink != "" {
+		go func() {
+			errs <- scanner.ListenSink(ctx, sink)
+			cancel()
+		}()
+		fmt.Fprintf(os.Stderr, "serve: bench sink on %s\n", sink)
+	}
+
+	srv := scanner.NewServer(zone, ns, []byte(secret), log)
+	fmt.Fprintf(os.Stderr, "serve: answering for %s on %s\n", srv.Zone, listen)
+	err := srv.ListenAndServe(ctx, listen)
+	cancel()
+	if sink != "" {
+		if sinkErr := <-errs; err == nil {
+			err = sinkErr
+		}
+	}
+	return err
+}
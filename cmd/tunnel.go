@@ -32,12 +32,13 @@ func runTunnel(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	dur := time.Duration(timeout) * time.Second
-	check := scanner.TunnelCheck(domain, count, ignoreRcodes)
+	transport, err := scanner.ParseTransport(transportName)
+	if err != nil {
+		return err
+	}
 
-	start := time.Now()
-	results := scanner.RunPool(ips, workers, dur, check, newProgress("resolve/tunnel"))
-	elapsed := time.Since(start)
+	dur := time.Duration(timeout) * time.Second
+	check := scanner.TunnelCheck(domain, transport, count, ignoreRcodes)
 
-	return writeReport("resolve/tunnel", results, elapsed, "resolve_ms")
+	return runScan(cmd, "resolve/tunnel", ips, dur, check, "resolve_ms", nil)
 }
@@ -0,0 +1,276 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// stallGap is how long a transfer may go without progress before the pause
+// counts as a stall.
+const stallGap = time.Second
+
+// maxSinkBytes bounds what the sink serves or reads per request.
+const maxSinkBytes = 1 << 30
+
+// Bench configures the throughput test run through an established tunnel.
+// Sink is the base URL of a server with speed.cloudflare.com style
+// endpoints: GET /__down?bytes=N returns N bytes and POST /__up accepts a
+// body. Each direction stops after its byte count or MaxTime, whichever
+// comes first.
+type Bench struct {
+	Sink      string
+	DownBytes int64
+	UpBytes   int64
+	MaxTime   time.Duration
+}
+
+// budget is how long a bench may run on top of the tunnel startup timeout.
+func (b Bench) budget() time.Duration {
+	return 2*b.MaxTime + 5*time.Second
+}
+
+// ClientBenchCheck starts c for each resolver and runs the bench through it.
+func ClientBenchCheck(c TunnelClient, proxyUser, proxyPass string, bench Bench, ports chan int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		var port int
+		select {
+		case port = <-ports:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { ports <- port }()
+
+		start := time.Now()
+
+		ctx, cancel := context.WithTimeout(ctx, timeout+bench.budget())
+		defer cancel()
+
+		stop, err := c.Start(ctx, t, port, timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer stop()
+		handshake := msSince(start)
+
+		client, err := proxyClient(c.Proxy(), port, proxyUser, proxyPass)
+		if err != nil {
+			return nil, newFailure("socks", err)
+		}
+		m, err := runBench(ctx, start, client, bench)
+		if err != nil {
+			return nil, err
+		}
+		m["handshake_ms"] = handshake
+		return m, nil
+	}
+}
+
+// SessionBenchCheck is ClientBenchCheck for a client run in process.
+func SessionBenchCheck(dial DialSession, socksUser, socksPass string, bench Bench) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		start := time.Now()
+
+		ctx, cancel := context.WithTimeout(ctx, timeout+bench.budget())
+		defer cancel()
+
+		hctx, hcancel := context.WithTimeout(ctx, timeout)
+		defer hcancel()
+		sess, err := dial(hctx, t, timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer sess.Close()
+		handshake := msSince(start)
+
+		client, err := socksClientVia("tunnel", sess, socksUser, socksPass)
+		if err != nil {
+			return nil, newFailure("socks", err)
+		}
+		m, err := runBench(ctx, start, client, bench)
+		if err != nil {
+			return nil, err
+		}
+		m["handshake_ms"] = handshake
+		sess.AddMetrics(m)
+		return m, nil
+	}
+}
+
+// runBench downloads and then uploads with a client from proxyClient. A
+// direction that runs out of time is measured on what got through; it only
+// fails if nothing did. e2e_ms is the time from start until the download's
+// response headers arrived.
+func runBench(ctx context.Context, start time.Time, client *http.Client, b Bench) (Metrics, error) {
+	m := Metrics{}
+	var stalls int
+
+	dctx, cancel := context.WithTimeout(ctx, b.MaxTime)
+	defer cancel()
+	req, err := http.NewRequestWithContext(dctx, http.MethodGet, b.Sink+"/__down?bytes="+strconv.FormatInt(b.DownBytes, 10), nil)
+	if err != nil {
+		return nil, newFailure("bench", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, newFailure("socks", err)
+	}
+	m["e2e_ms"] = msSince(start)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &Failure{Stage: "bench", Class: ClassHTTPStatus, Err: "download: HTTP " + strconv.Itoa(resp.StatusCode)}
+	}
+	down := &stallReader{r: io.LimitReader(resp.Body, b.DownBytes)}
+	t0 := time.Now()
+	_, err = io.Copy(io.Discard, down)
+	secs := time.Since(t0).Seconds()
+	resp.Body.Close()
+	if err := benchErr("download", down.read(), err); err != nil {
+		return nil, err
+	}
+	m["down_kbps"] = kbps(down.read(), secs)
+	stalls += down.stallCount()
+
+	if b.UpBytes > 0 {
+		uctx, cancel := context.WithTimeout(ctx, b.MaxTime)
+		defer cancel()
+		up := &stallReader{r: io.LimitReader(zeroReader{}, b.UpBytes)}
+		req, err := http.NewRequestWithContext(uctx, http.MethodPost, b.Sink+"/__up", up)
+		if err != nil {
+			return nil, newFailure("bench", err)
+		}
+		req.ContentLength = b.UpBytes
+		req.Header.Set("Content-Type", "application/octet-stream")
+		t0 := time.Now()
+		resp, err := client.Do(req)
+		secs := time.Since(t0).Seconds()
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return nil, &Failure{Stage: "bench", Class: ClassHTTPStatus, Err: "upload: HTTP " + strconv.Itoa(resp.StatusCode)}
+			}
+		}
+		if err := benchErr("upload", up.read(), err); err != nil {
+			return nil, err
+		}
+		m["up_kbps"] = kbps(up.read(), secs)
+		stalls += up.stallCount()
+	}
+	m["stalls"] = float64(stalls)
+	return m, nil
+}
+
+// benchErr turns the error ending a transfer into a failure, unless the
+// transfer merely ran out of time after moving some bytes.
+func benchErr(dir string, n int64, err error) error {
+	if err == nil || n > 0 && errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	f := newFailure("bench", err)
+	f.Err = dir + ": " + f.Err
+	return f
+}
+
+func kbps(n int64, secs float64) float64 {
+	if secs <= 0 {
+		return 0
+	}
+	return roundMs(float64(n) * 8 / 1000 / secs)
+}
+
+// stallReader counts the bytes read through it and the pauses longer than
+// stallGap, whether spent waiting inside Read (downloads) or between calls
+// (uploads, where the transport only reads when it can send). Uploads are
+// read from the transport's goroutine, hence the lock.
+type stallReader struct {
+	r io.Reader
+
+	mu     sync.Mutex
+	n      int64
+	stalls int
+	last   time.Time
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	enter := time.Now()
+	s.mu.Lock()
+	if !s.last.IsZero() && enter.Sub(s.last) > stallGap {
+		s.stalls++
+	}
+	s.mu.Unlock()
+
+	n, err := s.r.Read(p)
+
+	now := time.Now()
+	s.mu.Lock()
+	if now.Sub(enter) > stallGap {
+		s.stalls++
+	}
+	s.n += int64(n)
+	s.last = now
+	s.mu.Unlock()
+	return n, err
+}
+
+func (s *stallReader) read() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+func (s *stallReader) stallCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stalls
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// SinkHandler serves the bench endpoints, so a tunnel can be benchmarked
+// against a host under our control instead of a public speed test.
+func SinkHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /__down", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		if err != nil || n < 0 || n > maxSinkBytes {
+			http.Error(w, "bad bytes", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		io.Copy(w, io.LimitReader(zeroReader{}, n))
+	})
+	mux.HandleFunc("POST /__up", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, io.LimitReader(r.Body, maxSinkBytes))
+		fmt.Fprintf(w, "%d\n", n)
+	})
+	return mux
+}
+
+// ListenSink serves SinkHandler on addr until ctx is cancelled.
+func ListenSink(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: SinkHandler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
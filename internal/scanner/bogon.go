@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Bogon is an address range no legitimate answer points at: private or
+// reserved space, or a censor's sinkhole.
+type Bogon struct {
+	Prefix netip.Prefix
+	Label  string
+}
+
+// bogons starts out as the special-purpose ranges below; LoadBogons adds a
+// user's sinkholes. It is only written before a scan starts.
+var bogons []Bogon
+
+// nat64Prefix is the well-known DNS64 prefix. Synthesized answers are judged
+// by the IPv4 address embedded in their last 32 bits.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+func init() {
+	for _, b := range [][2]string{
+		{"0.0.0.0/8", "this-network"},
+		{"10.0.0.0/8", "private"},
+		{"100.64.0.0/10", "cgnat"},
+		{"127.0.0.0/8", "loopback"},
+		{"169.254.0.0/16", "link-local"},
+		{"172.16.0.0/12", "private"},
+		{"192.0.0.0/24", "ietf-protocol"},
+		{"192.0.2.0/24", "documentation"},
+		{"192.168.0.0/16", "private"},
+		{"198.18.0.0/15", "benchmark"},
+		{"198.51.100.0/24", "documentation"},
+		{"203.0.113.0/24", "documentation"},
+		{"224.0.0.0/4", "multicast"},
+		{"240.0.0.0/4", "reserved"},
+		{"::/128", "unspecified"},
+		{"::1/128", "loopback"},
+		{"100::/64", "discard"},
+		{"2001:db8::/32", "documentation"},
+		{"fc00::/7", "unique-local"},
+		{"fe80::/10", "link-local"},
+		{"ff00::/8", "multicast"},
+	} {
+		bogons = append(bogons, Bogon{netip.MustParsePrefix(b[0]), b[1]})
+	}
+}
+
+// matchBogon returns the most specific bogon range containing ip.
+func matchBogon(ip net.IP) (Bogon, bool) {
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Bogon{}, false
+	}
+	a = a.Unmap()
+	if nat64Prefix.Contains(a) {
+		a = netip.AddrFrom4([4]byte(a.AsSlice()[12:16]))
+	}
+	var best Bogon
+	found := false
+	for _, b := range bogons {
+		if b.Prefix.Contains(a) && (!found || b.Prefix.Bits() > best.Prefix.Bits()) {
+			best, found = b, true
+		}
+	}
+	return best, found
+}
+
+// LoadBogons adds the ranges in a bogon file to the built-in ones. Each line
+// holds a CIDR or single IP, optionally followed by a label naming the
+// sinkhole; blank lines and # comments are ignored.
+//
+//	10.10.34.34     blockpage-ir
+//	198.51.100.0/24 isp-sinkhole
+func LoadBogons(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		p, err := parseBogon(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		label := strings.Join(fields[1:], " ")
+		if label == "" {
+			label = "sinkhole"
+		}
+		bogons = append(bogons, Bogon{p, label})
+	}
+	return sc.Err()
+}
+
+func parseBogon(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
@@ -1,8 +1,10 @@
 package scanner
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"iter"
 	"os"
 	"time"
 )
@@ -12,6 +14,14 @@ type Step struct {
 	Timeout time.Duration
 	Check   CheckFunc
 	SortBy  string
+	Workers int // overrides the chain's worker count when > 0
+	// Prepare, if set, runs before the step tests any target, e.g. to take
+	// a reference answer. If it fails the chain stops there as if
+	// interrupted, so the run can be resumed once the cause is fixed.
+	Prepare func(ctx context.Context) error
+	// Params describes what the step was configured with, so a checkpoint
+	// is only resumed by the same chain.
+	Params map[string]string
 }
 
 type StepResult struct {
@@ -23,106 +33,303 @@ type StepResult struct {
 }
 
 type ChainReport struct {
-	Steps  []StepResult `json:"steps"`
-	Passed []IPRecord   `json:"passed"`
-	Failed []IPRecord   `json:"failed"`
+	Steps        []StepResult  `json:"steps"`
+	Passed       []IPRecord    `json:"passed"`
+	Failed       []IPRecord    `json:"failed"`
+	EgressGroups []EgressGroup `json:"egress_groups,omitempty"`
+	Interrupted  bool          `json:"interrupted,omitempty"`
 }
 
 type ProgressFactory func(stepName string) ProgressFunc
 
-func RunChain(ips []string, workers int, steps []Step, newProgress ProgressFactory) ChainReport {
-	fmt.Fprintf(os.Stdout, "chain: %d IPs, %d steps\n", len(ips), len(steps))
+type ChainOptions struct {
+	NewProgress ProgressFactory
+	// Resume continues a run from a loaded checkpoint instead of starting
+	// over with the input IPs.
+	Resume *Checkpoint
+	// CheckpointPath, if set, is where the run state is saved periodically
+	// and at every step boundary. It is removed once the chain completes.
+	CheckpointPath string
+	// OnRecord, if set, receives each IP's final record as soon as it is
+	// known: failures as they happen, passes as they clear the last step.
+	// Without a CheckpointPath, the first step's failures are then only
+	// passed to OnRecord and left out of the report, so that streaming a
+	// huge input does not keep a record per address.
+	OnRecord func(rec IPRecord, passed bool)
+}
+
+// RunChain runs steps in order, feeding the IPs that pass one step into the
+// next. If ctx is cancelled mid-step the chain stops there: the report holds
+// the completed steps plus the partial step, and Passed lists the IPs that
+// passed every step they were tested on, including those the partial step
+// never got to. Input IPs the first step never got to are left out.
+//
+// The input is only read by the first step; later steps get the IPs that
+// passed. A run resumed during the first step must be given the same input.
+func RunChain(ctx context.Context, input Targets, workers int, steps []Step, opts ChainOptions) ChainReport {
+	state := opts.Resume
+	if state == nil {
+		state = newCheckpoint(steps)
+		fmt.Fprintf(os.Stdout, "chain: %d IPs, %d steps\n", input.Len(), len(steps))
+	} else {
+		fmt.Fprintf(os.Stdout, "chain: resuming at step %d of %d, %d IPs already tested in it\n",
+			len(state.Completed)+1, len(steps), len(state.Results)+len(state.Failed)-state.StepFailed)
+	}
+
+	// Failures are normally kept for the report and the checkpoint. A
+	// streamed run without one has no use for them once they are emitted.
+	keepFailed := opts.OnRecord == nil || opts.CheckpointPath != ""
+
+	// savedResults and savedFailed are how much of state.Results and
+	// state.Failed the checkpoint file holds; savedResults is -1 until the
+	// file has been written in full.
+	savedResults, savedFailed := -1, 0
+	saveCheckpoint := func(full bool) {
+		if opts.CheckpointPath == "" {
+			return
+		}
+		var err error
+		if full || savedResults < 0 {
+			err = state.save(opts.CheckpointPath)
+		} else {
+			err = state.appendResults(opts.CheckpointPath, savedResults, savedFailed)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "chain: writing checkpoint: %v\n", err)
+			savedResults = -1
+			return
+		}
+		savedResults, savedFailed = len(state.Results), len(state.Failed)
+	}
 
-	current := ips
-	allFailed := make(map[string]struct{})
-	accumulated := make(map[string]Metrics)
-	var stepResults []StepResult
+	emit := func(stepIdx int, r Result) {
+		switch {
+		case opts.OnRecord == nil:
+		case !r.OK:
+			opts.OnRecord(IPRecord{Target: r.Target, Failure: r.Failure}, false)
+		case stepIdx == len(steps)-1:
+			m := make(Metrics, len(state.Metrics[r.String()])+len(r.Metrics))
+			for k, v := range state.Metrics[r.String()] {
+				m[k] = v
+			}
+			for k, v := range r.Metrics {
+				m[k] = v
+			}
+			opts.OnRecord(passedRecord(r.Target, m), true)
+		}
+	}
+
+	// A resumed run re-emits what the interrupted one already had
+	if opts.OnRecord != nil {
+		for _, rec := range state.Failed {
+			opts.OnRecord(rec, false)
+		}
+		for _, r := range state.Results {
+			emit(len(state.Completed), r)
+		}
+	}
+
+	stepResults := append([]StepResult(nil), state.Completed...)
+	current := input
+	if len(state.Completed) > 0 {
+		current = TargetList(state.Current)
+	}
+	var interrupted, ranLast bool
+	var remainder []Target // passed so far, but not tested by the partial step
+
+	for i := len(state.Completed); i < len(steps); i++ {
+		step := steps[i]
+		ranLast = i == len(steps)-1
+		keep := keepFailed || i > 0
+		failed := len(state.Failed) - state.StepFailed
 
-	for _, step := range steps {
 		var progress ProgressFunc
-		if newProgress != nil {
-			progress = newProgress(step.Name)
+		if opts.NewProgress != nil {
+			progress = opts.NewProgress(step.Name)
+		}
+		if prev := len(state.Results) + failed; progress != nil && prev > 0 {
+			// Count the results a resumed step already has
+			prevPass, prevFail := len(state.Results), failed
+			inner := progress
+			progress = func(done, total, passed, failed int) {
+				inner(done+prev, total+prev, passed+prevPass, failed+prevFail)
+			}
 		}
 
-		start := time.Now()
-		results := RunPool(current, workers, step.Timeout, step.Check, progress)
-		elapsed := time.Since(start)
+		// On resume, only IPs without a result yet are tested
+		pending := current
+		if len(state.Results)+failed > 0 {
+			pending = untested{current, state.stepTested()}
+		}
 
-		var passed, failed int
-		var nextIPs []string
-		for _, r := range results {
+		stepWorkers := workers
+		if step.Workers > 0 {
+			stepWorkers = step.Workers
+		}
+
+		if step.Prepare != nil {
+			if err := step.Prepare(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "chain: %s: %v\n", step.Name, err)
+				pending = TargetList(nil) // stops here, as below
+			}
+		}
+
+		prevElapsed := state.Elapsed
+		start := time.Now()
+		lastSave := start
+		RunPool(ctx, pending, stepWorkers, step.Timeout, step.Check, progress, func(r Result) {
 			if r.OK {
-				passed++
-				nextIPs = append(nextIPs, r.IP)
-				// Merge metrics into accumulated map
-				if accumulated[r.IP] == nil {
-					accumulated[r.IP] = make(Metrics)
-				}
-				for k, v := range r.Metrics {
-					accumulated[r.IP][k] = v
-				}
+				state.Results = append(state.Results, r)
 			} else {
+				r.Failure.Step = step.Name
 				failed++
-				allFailed[r.IP] = struct{}{}
+				if keep {
+					state.Failed = append(state.Failed, IPRecord{Target: r.Target, Failure: r.Failure})
+				}
+			}
+			emit(i, r)
+			if time.Since(lastSave) >= checkpointInterval {
+				state.Elapsed = prevElapsed + time.Since(start).Seconds()
+				saveCheckpoint(false)
+				lastSave = time.Now()
+			}
+		})
+		state.Elapsed = prevElapsed + time.Since(start).Seconds()
+		results := state.Results
+		passed := len(results)
+
+		stepDone := passed+failed == current.Len()
+		if !stepDone {
+			// Save before the partial results are merged below, so the
+			// checkpoint still describes this step as in progress.
+			saveCheckpoint(false)
+			interrupted = true
+		}
+
+		// Merge metrics into accumulated map
+		for _, r := range results {
+			key := r.String()
+			if state.Metrics[key] == nil {
+				state.Metrics[key] = make(Metrics)
+			}
+			for k, v := range r.Metrics {
+				state.Metrics[key][k] = v
 			}
 		}
 
 		// Sort passed results by step's primary metric
 		if step.SortBy != "" {
 			SortByMetric(results, step.SortBy)
-			nextIPs = nil
-			for _, r := range results {
-				if r.OK {
-					nextIPs = append(nextIPs, r.IP)
-				}
-			}
+		}
+		next := make([]Target, 0, passed)
+		for _, r := range results {
+			next = append(next, r.Target)
 		}
 
 		sr := StepResult{
 			Name:    step.Name,
-			Tested:  len(results),
+			Tested:  passed + failed,
 			Passed:  passed,
 			Failed:  failed,
-			Seconds: elapsed.Seconds(),
+			Seconds: state.Elapsed,
 		}
 		stepResults = append(stepResults, sr)
 
 		fmt.Fprintf(os.Stdout, "%-18s %d tested | %d pass | %d fail | %.1fs\n",
 			step.Name+":", sr.Tested, sr.Passed, sr.Failed, sr.Seconds)
 
-		current = nextIPs
+		if !stepDone {
+			if i > 0 {
+				for t := range (untested{current, state.stepTested()}).All() {
+					remainder = append(remainder, t)
+				}
+				next = append(next, remainder...)
+			}
+			current = TargetList(next)
+			break
+		}
+		current = TargetList(next)
+
+		state.Completed = stepResults
+		state.Current = next
+		state.Results = nil
+		state.StepFailed = len(state.Failed)
+		state.Elapsed = 0
+		saveCheckpoint(true)
+		if ctx.Err() != nil {
+			interrupted = len(state.Completed) < len(steps)
+			break
+		}
 	}
 
 	// Build IPRecord slices with accumulated metrics
-	passedRecords := make([]IPRecord, 0, len(current))
-	for _, ip := range current {
-		passedRecords = append(passedRecords, IPRecord{IP: ip, Metrics: accumulated[ip]})
+	passedRecords := make([]IPRecord, 0, current.Len())
+	for t := range current.All() {
+		passedRecords = append(passedRecords, passedRecord(t, state.Metrics[t.String()]))
 	}
-
-	failedRecords := make([]IPRecord, 0, len(allFailed))
-	for ip := range allFailed {
-		failedRecords = append(failedRecords, IPRecord{IP: ip})
+	if opts.OnRecord != nil {
+		if !ranLast {
+			// Interrupted before the last step: these passed everything so far
+			for _, rec := range passedRecords {
+				opts.OnRecord(rec, true)
+			}
+		} else {
+			for _, t := range remainder {
+				opts.OnRecord(passedRecord(t, state.Metrics[t.String()]), true)
+			}
+		}
 	}
 
+	failedRecords := append(make([]IPRecord, 0, len(state.Failed)), state.Failed...)
+
 	report := ChainReport{
-		Steps:  stepResults,
-		Passed: passedRecords,
-		Failed: failedRecords,
+		Steps:       stepResults,
+		Passed:      passedRecords,
+		Failed:      failedRecords,
+		Interrupted: interrupted,
 	}
 	if report.Passed == nil {
 		report.Passed = []IPRecord{}
 	}
 
 	totalDuration := 0.0
+	totalFailed := 0
 	for _, sr := range stepResults {
 		totalDuration += sr.Seconds
+		totalFailed += sr.Failed
 	}
 	fmt.Fprintf(os.Stdout, "\nchain: %d passed | %d failed | %.1fs\n",
-		len(report.Passed), len(report.Failed), totalDuration)
+		len(report.Passed), totalFailed, totalDuration)
+	if interrupted {
+		fmt.Fprintf(os.Stdout, "chain: interrupted after %d of %d steps\n", len(stepResults), len(steps))
+		if opts.CheckpointPath != "" {
+			fmt.Fprintf(os.Stdout, "chain: resume with --resume %s\n", opts.CheckpointPath)
+		}
+	} else if opts.CheckpointPath != "" {
+		os.Remove(opts.CheckpointPath)
+	}
 
 	return report
 }
 
+// untested is a step's input minus the targets it already has results for.
+type untested struct {
+	all    Targets
+	tested map[Target]struct{}
+}
+
+func (u untested) Len() int { return u.all.Len() - len(u.tested) }
+
+func (u untested) All() iter.Seq[Target] {
+	return func(yield func(Target) bool) {
+		for t := range u.all.All() {
+			if _, ok := u.tested[t]; !ok && !yield(t) {
+				return
+			}
+		}
+	}
+}
+
 func WriteChainReport(report ChainReport, path string) error {
 	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
@@ -2,122 +2,292 @@ package scanner
 
 import (
 	"context"
-	"fmt"
-	"os/exec"
-	"regexp"
+	"math"
+	"net"
 	"strconv"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 const maxConsecFail = 3
 
-var pingAvgRegex = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+// PingCheck sends count ICMP echo requests, one after another, and reports
+// RTT statistics. Like the DNS checks it gives up after maxConsecFail losses
+// in a row; a single reply is enough to pass.
+func PingCheck(count int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		addr := net.ParseIP(t.IP)
+		if addr == nil {
+			return nil, &Failure{Stage: "ping", Class: ClassNetwork, Err: "invalid IP " + t.IP}
+		}
+		p, err := sharedPinger(addr.To4() == nil)
+		if err != nil {
+			return nil, newFailure("ping", err)
+		}
+
+		var rtts []float64
+		var sent, consecFail int
+		var lastErr error
+		for sent < count && consecFail < maxConsecFail {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			sent++
+			rtt, err := p.ping(ctx, addr, timeout)
+			if err != nil {
+				lastErr = err
+				consecFail++
+				continue
+			}
+			consecFail = 0
+			rtts = append(rtts, float64(rtt.Microseconds())/1000.0)
+		}
 
-func parsePingAvg(output string) float64 {
-	m := pingAvgRegex.FindStringSubmatch(output)
-	if len(m) < 2 {
-		return 0
+		if len(rtts) == 0 {
+			if f, ok := lastErr.(*Failure); ok && f.Class == ClassTimeout {
+				return nil, &Failure{Stage: "ping", Class: ClassNoReply}
+			}
+			return nil, newFailure("ping", lastErr)
+		}
+		return pingMetrics(rtts, sent), nil
 	}
-	v, err := strconv.ParseFloat(m[1], 64)
-	if err != nil {
-		return 0
+}
+
+func pingMetrics(rtts []float64, sent int) Metrics {
+	minRTT, maxRTT, sum := rtts[0], rtts[0], 0.0
+	var jitter float64
+	for i, v := range rtts {
+		minRTT = math.Min(minRTT, v)
+		maxRTT = math.Max(maxRTT, v)
+		sum += v
+		if i > 0 {
+			jitter += math.Abs(v - rtts[i-1])
+		}
+	}
+	if len(rtts) > 1 {
+		jitter /= float64(len(rtts) - 1)
+	}
+	return Metrics{
+		"ping_ms":        roundMs(sum / float64(len(rtts))),
+		"ping_min_ms":    roundMs(minRTT),
+		"ping_max_ms":    roundMs(maxRTT),
+		"ping_jitter_ms": roundMs(jitter),
+		"ping_loss_pct":  roundMs(100 * float64(sent-len(rtts)) / float64(sent)),
 	}
-	return v
 }
 
-func PingCheck(count int) CheckFunc {
-	return func(ip string, timeout time.Duration) (bool, Metrics) {
-		secs := int(timeout.Seconds())
-		if secs < 1 {
-			secs = 1
-		}
-		deadline := count + secs
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(deadline+2)*time.Second)
-		defer cancel()
-
-		cmd := exec.CommandContext(ctx, "ping",
-			"-c", fmt.Sprintf("%d", count),
-			"-W", fmt.Sprintf("%d", secs),
-			"-w", fmt.Sprintf("%d", deadline),
-			ip)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return false, nil
+// measureAttempts runs attempt count times and returns the average time of
+// the successful attempts. It gives up after maxConsecFail failures in a row,
+// returning the last failure.
+func measureAttempts(ctx context.Context, count int, attempt func() error) (float64, error) {
+	var successes []float64
+	var consecFail int
+	var lastErr error
+
+	for i := 0; i < count; i++ {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		start := time.Now()
+		if err := attempt(); err == nil {
+			ms := float64(time.Since(start).Microseconds()) / 1000.0
+			successes = append(successes, ms)
+			consecFail = 0
+		} else {
+			lastErr = err
+			consecFail++
+			if consecFail >= maxConsecFail {
+				return 0, lastErr
+			}
 		}
-		avg := parsePingAvg(string(out))
-		return true, Metrics{"ping_ms": avg}
 	}
+
+	if len(successes) == 0 {
+		return 0, lastErr
+	}
+
+	var sum float64
+	for _, v := range successes {
+		sum += v
+	}
+	return roundMs(sum / float64(len(successes))), nil
 }
 
-func ResolveCheck(domain string, count int, ignoreRcodes []int) CheckFunc {
-	return func(ip string, timeout time.Duration) (bool, Metrics) {
-		var successes []float64
-		var consecFail int
-
-		for i := 0; i < count; i++ {
-			start := time.Now()
-			if QueryA(ip, domain, timeout, ignoreRcodes) {
-				ms := float64(time.Since(start).Microseconds()) / 1000.0
-				successes = append(successes, ms)
-				consecFail = 0
-			} else {
-				consecFail++
-				if consecFail >= maxConsecFail {
-					return false, nil
-				}
+// TCPPingCheck measures how long a TCP connect to the resolver takes, for
+// networks that drop ICMP. Port 0 connects to the target's own DNS port.
+func TCPPingCheck(port, count int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		addr := t.Addr()
+		if port != 0 {
+			addr = net.JoinHostPort(t.IP, strconv.Itoa(port))
+		}
+		ms, err := measureAttempts(ctx, count, func() error {
+			d := net.Dialer{Timeout: timeout}
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return newFailure("ping", err)
 			}
+			conn.Close()
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
+		return Metrics{"ping_ms": ms}, nil
+	}
+}
 
-		if len(successes) == 0 {
-			return false, nil
+// UDPPingCheck sends a minimal DNS query over UDP. Any reply counts,
+// whatever its rcode: it only proves something answers DNS on the port.
+func UDPPingCheck(count int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		ms, err := measureAttempts(ctx, count, func() error {
+			return pingDNS(ctx, t.Addr(), timeout)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return Metrics{"ping_ms": ms}, nil
+	}
+}
+
+// measureTransports runs measureAttempts over the transport selected by
+// transport ("udp", "tcp" or "both") and reports resolve_ms along with the
+// transport used. In both mode a target passes if either transport works;
+// resolve_udp_ms and resolve_tcp_ms are recorded for those that did, and
+// resolve_ms is the faster of the two.
+func measureTransports(ctx context.Context, transport string, count int, attempt func(network string) error) (Metrics, error) {
+	if transport != "both" {
+		ms, err := measureAttempts(ctx, count, func() error { return attempt(transport) })
+		if err != nil {
+			return nil, err
 		}
+		return Metrics{"resolve_ms": ms, "transport": transport}, nil
+	}
 
-		var sum float64
-		for _, v := range successes {
-			sum += v
+	m := Metrics{}
+	var worked []string
+	var firstErr error
+	best := math.MaxFloat64
+	for _, network := range []string{"udp", "tcp"} {
+		ms, err := measureAttempts(ctx, count, func() error { return attempt(network) })
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
-		return true, Metrics{"resolve_ms": roundMs(sum / float64(len(successes)))}
+		m["resolve_"+network+"_ms"] = ms
+		worked = append(worked, network)
+		best = math.Min(best, ms)
+	}
+	switch len(worked) {
+	case 0:
+		return nil, firstErr
+	case 1:
+		m["transport"] = worked[0]
+	default:
+		m["transport"] = "both"
 	}
+	m["resolve_ms"] = best
+	return m, nil
 }
 
-// TunnelCheck tests whether each resolver can reach the tunnel server by sending
-// NS queries for the tunnel domain. Any response (including NXDOMAIN) proves the
-// resolver can route queries to the tunnel server. Only timeouts count as failure.
-func TunnelCheck(domain string, count int, ignoreRcodes []int) CheckFunc {
-	return func(ip string, timeout time.Duration) (bool, Metrics) {
-		// Step 1: Discover NS delegation from parent authoritative server (once)
-		hosts, ok := DiscoverNS(ip, domain, timeout, ignoreRcodes)
-		if !ok || len(hosts) == 0 {
-			return false, nil
+// measureResolver runs attempt against t. DoH and DoT resolvers are queried
+// over their own protocol after probing their TLS setup, and fail there if
+// their certificate does not verify unless InsecureTLS is set; plain
+// resolvers over transport.
+func measureResolver(ctx context.Context, t Target, transport string, count int, timeout time.Duration, attempt func(network, resolver string) error) (Metrics, error) {
+	network := t.Network()
+	if network == "" {
+		return measureTransports(ctx, transport, count, func(n string) error {
+			return attempt(n, t.Addr())
+		})
+	}
+
+	m, err := cachedProbeTLS(ctx, t, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if valid, _ := m["cert_valid"].(bool); !valid && !InsecureTLS {
+		return nil, &Failure{Stage: "tls", Class: ClassBadCert, Err: "certificate not valid for " + t.IP}
+	}
+	_, resolver := resolverFor(t, "")
+	ms, err := measureAttempts(ctx, count, func() error { return attempt(network, resolver) })
+	if err != nil {
+		return nil, err
+	}
+	m["resolve_ms"] = ms
+	m["transport"] = network
+	return m, nil
+}
+
+// ResolveCheck queries domain for A or AAAA records (qtype).
+func ResolveCheck(domain string, qtype uint16, transport string, count int, ignoreRcodes []int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		return measureResolver(ctx, t, transport, count, timeout, func(network, resolver string) error {
+			return QueryAddr(ctx, network, resolver, domain, qtype, timeout, ignoreRcodes)
+		})
+	}
+}
+
+// TunnelCheck tests whether each resolver can reach the tunnel server. It
+// discovers the tunnel domain's delegation, checks that the resolver can
+// resolve the NS host, then sends an NS query for the tunnel domain itself:
+// any response (including NXDOMAIN) proves the resolver can route queries to
+// the tunnel server.
+func TunnelCheck(domain, transport string, count int, ignoreRcodes []int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		network, resolver := resolverFor(t, transport)
+
+		// Step 1: Discover NS delegation, walking referrals from the parent zone
+		del, err := DiscoverNS(ctx, network, resolver, domain, timeout, ignoreRcodes)
+		if err != nil {
+			return nil, err
 		}
-		nsHost := strings.TrimRight(hosts[0], ".")
+		nsHost := del.Hosts[0]
 
 		// Step 2: Verify resolver can resolve the NS hostname (repeated)
-		var successes []float64
-		var consecFail int
-
-		for i := 0; i < count; i++ {
-			start := time.Now()
-			if QueryA(ip, nsHost, timeout, ignoreRcodes) {
-				ms := float64(time.Since(start).Microseconds()) / 1000.0
-				successes = append(successes, ms)
-				consecFail = 0
-			} else {
-				consecFail++
-				if consecFail >= maxConsecFail {
-					return false, nil
-				}
+		m, err := measureResolver(ctx, t, transport, count, timeout, func(network, resolver string) error {
+			return QueryA(ctx, network, resolver, nsHost, timeout, ignoreRcodes)
+		})
+		if err != nil {
+			if f, ok := err.(*Failure); ok && f.Stage == "query" {
+				f.Stage = "ns-resolve"
 			}
+			return nil, err
 		}
 
-		if len(successes) == 0 {
-			return false, nil
+		// Step 3: Verify queries for the tunnel domain reach the tunnel server
+		if err := QueryTunnel(ctx, network, resolver, domain, dns.TypeNS, timeout); err != nil {
+			if f, ok := err.(*Failure); ok {
+				f.Stage = "tunnel"
+			}
+			return nil, err
 		}
 
-		var sum float64
-		for _, v := range successes {
-			sum += v
+		m["ns_host"] = nsHost
+		m["ns_ttl"] = float64(del.NSTTL)
+		if len(del.Glue) > 0 {
+			m["glue_ips"] = del.Glue
+			m["glue_ttl"] = float64(del.GlueTTL)
 		}
-		return true, Metrics{"resolve_ms": roundMs(sum / float64(len(successes)))}
+		return m, nil
+	}
+}
+
+// resolverFor returns the network and address to query t over: its own
+// protocol for DoH and DoT, else transport, with UDP standing in for both.
+func resolverFor(t Target, transport string) (network, resolver string) {
+	switch t.Network() {
+	case "doh":
+		return "doh", t.URL
+	case "dot":
+		return "dot", t.Addr()
+	}
+	if transport == "both" {
+		return "udp", t.Addr()
 	}
+	return transport, t.Addr()
 }
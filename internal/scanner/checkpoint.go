@@ -0,0 +1,178 @@
+package scanner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+const checkpointInterval = 30 * time.Second
+
+// Checkpoint is the saved state of a chain run. Completed steps are final.
+// The in-progress step's passes so far are in Results and its failures are
+// in Failed from StepFailed on, so a resumed run only tests the remaining
+// targets in Current. Current is empty while the first step runs, as that
+// step reads the (possibly huge) input instead.
+//
+// On disk the state is one JSON line, followed by one line per batch of
+// results appended since, so periodic saves only write the new ones.
+type Checkpoint struct {
+	Started    time.Time           `json:"started"` // when the chain first started
+	Steps      []string            `json:"steps"`
+	Params     []map[string]string `json:"params"`
+	Completed  []StepResult        `json:"completed"`
+	Current    []Target            `json:"current,omitempty"`
+	Results    []Result            `json:"-"`
+	Elapsed    float64             `json:"elapsed_secs"`
+	Metrics    map[string]Metrics  `json:"metrics"` // keyed by Target.String()
+	Failed     []IPRecord          `json:"failed"`
+	StepFailed int                 `json:"step_failed"`
+}
+
+// checkpointBatch is a line of results appended to a checkpoint file, with
+// the step's elapsed time as of the append.
+type checkpointBatch struct {
+	Elapsed float64    `json:"elapsed_secs"`
+	Results []Result   `json:"results,omitempty"`
+	Failed  []IPRecord `json:"failed,omitempty"`
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var cp Checkpoint
+	if err := dec.Decode(&cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	for {
+		var b checkpointBatch
+		err := dec.Decode(&b)
+		// A crash during an append leaves a truncated last line
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+		}
+		cp.Results = append(cp.Results, b.Results...)
+		cp.Failed = append(cp.Failed, b.Failed...)
+		cp.Elapsed = b.Elapsed
+	}
+	if cp.Metrics == nil {
+		cp.Metrics = make(map[string]Metrics)
+	}
+	return &cp, nil
+}
+
+// Matches reports an error if the checkpoint was written for a different
+// sequence of steps, or for the same steps with other params.
+func (cp *Checkpoint) Matches(steps []Step) error {
+	if len(cp.Steps) != len(steps) {
+		return fmt.Errorf("checkpoint has %d steps, chain has %d", len(cp.Steps), len(steps))
+	}
+	if len(cp.Params) != len(steps) {
+		return fmt.Errorf("checkpoint has no step params (written by an older version)")
+	}
+	for i, s := range steps {
+		if cp.Steps[i] != s.Name {
+			return fmt.Errorf("checkpoint step %d is %q, chain has %q", i+1, cp.Steps[i], s.Name)
+		}
+		if k, ok := paramDiff(cp.Params[i], s.Params); ok {
+			return fmt.Errorf("checkpoint step %d (%s) has %s=%q, chain has %q", i+1, s.Name, k, cp.Params[i][k], s.Params[k])
+		}
+	}
+	if len(cp.Completed) > len(steps) {
+		return fmt.Errorf("checkpoint has more completed steps than the chain")
+	}
+	return nil
+}
+
+// paramDiff returns the first param, in key order, that a and b disagree on.
+func paramDiff(a, b map[string]string) (string, bool) {
+	keys := slices.Sorted(maps.Keys(a))
+	keys = append(keys, slices.Sorted(maps.Keys(b))...)
+	for _, k := range keys {
+		va, oka := a[k]
+		vb, okb := b[k]
+		if oka != okb || va != vb {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// save writes the whole checkpoint atomically so a crash mid-write never
+// leaves a truncated file behind.
+func (cp *Checkpoint) save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if len(cp.Results) > 0 {
+		batch, err := json.Marshal(checkpointBatch{Elapsed: cp.Elapsed, Results: cp.Results})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, batch...), '\n')
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// appendResults adds Results and Failed from the given indexes on to a
+// checkpoint file written by save.
+func (cp *Checkpoint) appendResults(path string, results, failed int) error {
+	batch, err := json.Marshal(checkpointBatch{Elapsed: cp.Elapsed, Results: cp.Results[results:], Failed: cp.Failed[failed:]})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(batch, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stepTested returns the targets the in-progress step has results for.
+func (cp *Checkpoint) stepTested() map[Target]struct{} {
+	tested := make(map[Target]struct{}, len(cp.Results)+len(cp.Failed)-cp.StepFailed)
+	for _, r := range cp.Results {
+		tested[r.Target] = struct{}{}
+	}
+	for _, rec := range cp.Failed[cp.StepFailed:] {
+		tested[rec.Target] = struct{}{}
+	}
+	return tested
+}
+
+func newCheckpoint(steps []Step) *Checkpoint {
+	names := make([]string, len(steps))
+	params := make([]map[string]string, len(steps))
+	for i, s := range steps {
+		names[i] = s.Name
+		params[i] = s.Params
+	}
+	return &Checkpoint{
+		Started: time.Now(),
+		Steps:   names,
+		Params:  params,
+		Metrics: make(map[string]Metrics),
+	}
+}
@@ -0,0 +1,181 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TunnelAdapter makes the TunnelClient of an e2e step from the step's params.
+type TunnelAdapter struct {
+	Params []string // params the step must set
+	New    func(params map[string]string) TunnelClient
+	// Embedded, if set, runs the client in process instead, for steps that
+	// ask for it with "embedded: true".
+	Embedded func(params map[string]string) (DialSession, error)
+}
+
+// tunnelAdapters holds the clients usable as e2e/<name> steps. Config-defined
+// clients are added before any scan starts.
+var tunnelAdapters = map[string]TunnelAdapter{
+	"dnstt": {
+		Params: []string{"domain", "pubkey"},
+		New: func(p map[string]string) TunnelClient {
+			return DnsttClient{Domain: p["domain"], Pubkey: p["pubkey"]}
+		},
+		Embedded: func(p map[string]string) (DialSession, error) {
+			key, err := ParseDnsttPubkey(p["pubkey"])
+			if err != nil {
+				return nil, err
+			}
+			return DnsttSession(p["domain"], key), nil
+		},
+	},
+	"slipstream": {
+		Params: []string{"domain"},
+		New: func(p map[string]string) TunnelClient {
+			return SlipstreamClient{Domain: p["domain"], Cert: p["cert"]}
+		},
+	},
+}
+
+var clientNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// RegisterTunnelAdapter adds a tunnel client under name. Built-in clients
+// cannot be replaced, and names ending in -bench are taken by bench steps.
+func RegisterTunnelAdapter(name string, a TunnelAdapter) error {
+	if !clientNameRE.MatchString(name) || strings.HasSuffix(name, "-bench") {
+		return fmt.Errorf("invalid tunnel client name %q", name)
+	}
+	if _, ok := tunnelAdapters[name]; ok {
+		return fmt.Errorf("tunnel client %q already defined", name)
+	}
+	tunnelAdapters[name] = a
+	return nil
+}
+
+func LookupTunnelAdapter(name string) (TunnelAdapter, bool) {
+	a, ok := tunnelAdapters[name]
+	return a, ok
+}
+
+// placeholderRE matches the {name} placeholders of CommandClient args.
+var placeholderRE = regexp.MustCompile(`\{([a-z0-9-]+)\}`)
+
+// commandPlaceholders are filled in from the resolver and the local port;
+// any other placeholder names a step param.
+var commandPlaceholders = []string{"resolver", "ip", "port", "url", "listen", "local-port"}
+
+// CommandClient is a tunnel client defined in config: a binary run with
+// argument templates. In Args, {resolver} is the resolver's host:port, {ip}
+// and {port} are its parts, {url} is its DoH or DoT URL, {listen} is the
+// proxy address 127.0.0.1:<local port> and {local-port} the port alone.
+// Any other {name} is the step param of that name. Only clients whose args
+// use {url} are given DoH and DoT resolvers.
+type CommandClient struct {
+	Command   string
+	Args      []string
+	Ready     Readiness
+	ProxyKind string
+	Params    map[string]string
+}
+
+// NewCommandAdapter checks the definition of a config-defined client and
+// returns its adapter. params are the step params it requires; every
+// placeholder in args must be one of them or a built-in one. ready is
+// "socks", "port" or "output:<text>", and defaults to "socks" for SOCKS5
+// proxies and "port" for HTTP ones.
+func NewCommandAdapter(command string, args, params []string, proxy, ready string) (TunnelAdapter, error) {
+	if command == "" {
+		return TunnelAdapter{}, fmt.Errorf("missing command")
+	}
+	switch proxy {
+	case "":
+		proxy = ProxySOCKS5
+	case ProxySOCKS5, ProxyHTTP, ProxyNone:
+	default:
+		return TunnelAdapter{}, fmt.Errorf("invalid proxy %q (want %s, %s or %s)", proxy, ProxySOCKS5, ProxyHTTP, ProxyNone)
+	}
+
+	var r Readiness
+	kind, match, _ := strings.Cut(ready, ":")
+	switch kind {
+	case "":
+		switch proxy {
+		case ProxySOCKS5:
+			r.Kind = ReadySOCKS
+		case ProxyHTTP:
+			r.Kind = ReadyPort
+		default:
+			return TunnelAdapter{}, fmt.Errorf("proxy %s needs ready: output:<text>", proxy)
+		}
+	case ReadySOCKS:
+		if proxy != ProxySOCKS5 {
+			return TunnelAdapter{}, fmt.Errorf("ready socks needs proxy %s", ProxySOCKS5)
+		}
+		r.Kind = kind
+	case ReadyPort:
+		if proxy == ProxyNone {
+			return TunnelAdapter{}, fmt.Errorf("ready port needs a proxy")
+		}
+		r.Kind = kind
+	case ReadyOutput:
+		if match == "" {
+			return TunnelAdapter{}, fmt.Errorf("ready output needs text to match, as output:<text>")
+		}
+		r = Readiness{Kind: kind, Match: match}
+	default:
+		return TunnelAdapter{}, fmt.Errorf("invalid ready %q (want socks, port or output:<text>)", ready)
+	}
+
+	for _, p := range params {
+		if slices.Contains(commandPlaceholders, p) {
+			return TunnelAdapter{}, fmt.Errorf("param %q clashes with the built-in {%s}", p, p)
+		}
+	}
+	for _, arg := range args {
+		for _, m := range placeholderRE.FindAllStringSubmatch(arg, -1) {
+			if !slices.Contains(commandPlaceholders, m[1]) && !slices.Contains(params, m[1]) {
+				return TunnelAdapter{}, fmt.Errorf("arg %q: unknown placeholder {%s}", arg, m[1])
+			}
+		}
+	}
+
+	return TunnelAdapter{
+		Params: params,
+		New: func(p map[string]string) TunnelClient {
+			return CommandClient{Command: command, Args: args, Ready: r, ProxyKind: proxy, Params: p}
+		},
+	}, nil
+}
+
+func (c CommandClient) Proxy() string { return c.ProxyKind }
+
+func (c CommandClient) Start(ctx context.Context, t Target, port int, timeout time.Duration) (func(), error) {
+	if t.URL != "" && !slices.ContainsFunc(c.Args, func(a string) bool { return strings.Contains(a, "{url}") }) {
+		return nil, &Failure{Stage: "client", Class: ClassNetwork, Err: c.Command + " does not support DoH/DoT resolvers"}
+	}
+	vars := map[string]string{
+		"resolver":   t.Addr(),
+		"ip":         t.IP,
+		"port":       strconv.Itoa(t.Port),
+		"url":        t.URL,
+		"listen":     fmt.Sprintf("127.0.0.1:%d", port),
+		"local-port": strconv.Itoa(port),
+	}
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = placeholderRE.ReplaceAllStringFunc(arg, func(m string) string {
+			name := m[1 : len(m)-1]
+			if v, ok := vars[name]; ok {
+				return v
+			}
+			return c.Params[name]
+		})
+	}
+	return startClient(ctx, c.Command, args, port, c.Ready, timeout)
+}
@@ -4,37 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-var bogusNets []*net.IPNet
-
-func init() {
-	for _, cidr := range []string{
-		"0.0.0.0/8",
-		"10.0.0.0/8",
-		"127.0.0.0/8",
-		"169.254.0.0/16",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-	} {
-		_, n, _ := net.ParseCIDR(cidr)
-		bogusNets = append(bogusNets, n)
-	}
-}
-
-func isBogusIP(ip net.IP) bool {
-	for _, n := range bogusNets {
-		if n.Contains(ip) {
-			return true
-		}
-	}
-	return false
-}
-
 // ParseRcode converts a human-readable rcode name to its integer value.
 // Supported names: nxdomain, servfail, refused, formerr.
 func ParseRcode(name string) (int, error) {
@@ -52,48 +29,127 @@ func ParseRcode(name string) (int, error) {
 	}
 }
 
-func query(resolver, domain string, qtype uint16, timeout time.Duration, ignoreRcodes []int) (*dns.Msg, bool) {
+// ParseQtype converts a query type name such as "txt" or "null" to its
+// value.
+func ParseQtype(name string) (uint16, error) {
+	t, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown query type %q", name)
+	}
+	return t, nil
+}
+
+// ParseAddrType converts "a" or "aaaa" to the DNS query type.
+func ParseAddrType(name string) (uint16, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "a":
+		return dns.TypeA, nil
+	case "aaaa":
+		return dns.TypeAAAA, nil
+	default:
+		return 0, fmt.Errorf("unknown query type %q (supported: a, aaaa)", name)
+	}
+}
+
+// ParseTransport validates a --transport value: udp, tcp or both.
+func ParseTransport(name string) (string, error) {
+	switch t := strings.ToLower(strings.TrimSpace(name)); t {
+	case "udp", "tcp", "both":
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown transport %q (supported: udp, tcp, both)", name)
+	}
+}
+
+// query sends a recursive query to resolver and fails on any rcode other
+// than NOERROR.
+func query(ctx context.Context, network, resolver, domain string, qtype uint16, timeout time.Duration, ignoreRcodes []int) (*dns.Msg, error) {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(domain), qtype)
 	m.RecursionDesired = true
 
+	r, err := exchange(ctx, network, resolver, m, timeout, ignoreRcodes)
+	if err != nil {
+		return nil, newFailure("query", err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, rcodeFailure("query", r.Rcode)
+	}
+	return r, nil
+}
+
+// exchange sends m to resolver over network: "udp", "tcp" or "dot" with
+// resolver given as host:port, or "doh" with resolver a URL.
+func exchange(ctx context.Context, network, resolver string, m *dns.Msg, timeout time.Duration, ignoreRcodes []int) (*dns.Msg, error) {
 	c := new(dns.Client)
-	c.Net = "udp"
+	c.Net = network
 	c.Timeout = timeout
 	c.IgnoreRcodes = ignoreRcodes
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	r, _, err := c.ExchangeContext(ctx, m, resolver+":53")
-	if err != nil || r == nil || r.Rcode != dns.RcodeSuccess {
-		return nil, false
+	switch network {
+	case "doh":
+		return exchangeDoH(ctx, resolver, m)
+	case "dot":
+		c.Net = "tcp-tls"
+		c.TLSConfig = dotConfig(resolver)
 	}
-	return r, true
+	r, _, err := c.ExchangeContext(ctx, m, resolver)
+	return r, err
 }
 
-func QueryA(resolver, domain string, timeout time.Duration, ignoreRcodes []int) bool {
-	r, ok := query(resolver, domain, dns.TypeA, timeout, ignoreRcodes)
-	if !ok {
-		return false
+func rcodeFailure(stage string, rcode int) *Failure {
+	return &Failure{Stage: stage, Class: ClassRcode, Rcode: dns.RcodeToString[rcode]}
+}
+
+// pingDNS sends an NS query for the root zone and accepts any reply.
+func pingDNS(ctx context.Context, resolver string, timeout time.Duration) error {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+
+	if _, err := exchange(ctx, "udp", resolver, m, timeout, nil); err != nil {
+		return newFailure("ping", err)
+	}
+	return nil
+}
+
+func QueryA(ctx context.Context, network, resolver, domain string, timeout time.Duration, ignoreRcodes []int) error {
+	return QueryAddr(ctx, network, resolver, domain, dns.TypeA, timeout, ignoreRcodes)
+}
+
+// QueryAddr queries domain for A or AAAA records (qtype) and fails if the
+// answer is empty or points at a bogus address.
+func QueryAddr(ctx context.Context, network, resolver, domain string, qtype uint16, timeout time.Duration, ignoreRcodes []int) error {
+	r, err := query(ctx, network, resolver, domain, qtype, timeout, ignoreRcodes)
+	if err != nil {
+		return err
 	}
 	if len(r.Answer) == 0 {
-		return false
+		return &Failure{Stage: "query", Class: ClassEmptyAnswer}
 	}
 	for _, ans := range r.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			if isBogusIP(a.A) {
-				return false
-			}
+		var ip net.IP
+		switch a := ans.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		if b, ok := matchBogon(ip); ok {
+			return &Failure{Stage: "query", Class: ClassBogusAnswer, Sinkhole: b.Label, Err: "answer " + ip.String() + " in " + b.Prefix.String()}
 		}
 	}
-	return true
+	return nil
 }
 
-func QueryNS(resolver, domain string, timeout time.Duration, ignoreRcodes []int) ([]string, bool) {
-	r, ok := query(resolver, domain, dns.TypeNS, timeout, ignoreRcodes)
-	if !ok {
-		return nil, false
+func QueryNS(ctx context.Context, network, resolver, domain string, timeout time.Duration, ignoreRcodes []int) ([]string, error) {
+	r, err := query(ctx, network, resolver, domain, dns.TypeNS, timeout, ignoreRcodes)
+	if err != nil {
+		return nil, err
 	}
 	var hosts []string
 	for _, ans := range r.Answer {
@@ -102,32 +158,328 @@ func QueryNS(resolver, domain string, timeout time.Duration, ignoreRcodes []int)
 		}
 	}
 	if len(hosts) == 0 {
-		return nil, false
+		return nil, &Failure{Stage: "query", Class: ClassEmptyAnswer}
 	}
-	return hosts, true
+	return hosts, nil
 }
 
-// QueryTunnel sends an NS query for the tunnel domain and returns true if the
-// query reached the tunnel server. DNSTT servers typically return NXDOMAIN or
-// NOERROR — both prove the resolver routed the query to the tunnel server.
-// SERVFAIL means the resolver couldn't reach the tunnel server (e.g., it's down),
-// and timeouts mean the resolver itself is unreachable or blocked.
-func QueryTunnel(resolver, domain string, timeout time.Duration) bool {
+// QueryTunnel sends a query of type qtype for name, at or under the tunnel
+// domain, and returns nil if the query reached the tunnel server. DNSTT
+// servers typically return NXDOMAIN or NOERROR — both prove the resolver
+// routed the query to the tunnel server. SERVFAIL means the resolver couldn't
+// reach the tunnel server (e.g., it's down), and timeouts mean the resolver
+// itself is unreachable or blocked.
+func QueryTunnel(ctx context.Context, network, resolver, name string, qtype uint16, timeout time.Duration) error {
 	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(domain), dns.TypeNS)
+	m.SetQuestion(dns.Fqdn(name), qtype)
 	m.RecursionDesired = true
 
-	c := new(dns.Client)
-	c.Net = "udp"
-	c.Timeout = timeout
+	r, err := exchange(ctx, network, resolver, m, timeout, nil)
+	if err != nil {
+		return newFailure("query", err)
+	}
+	// SERVFAIL means the resolver couldn't reach the tunnel server
+	if r.Rcode == dns.RcodeServerFailure {
+		return rcodeFailure("query", r.Rcode)
+	}
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// maxReferrals bounds how many zone cuts DiscoverNS follows below the
+// closest enclosing zone it starts from.
+const maxReferrals = 8
 
-	r, _, err := c.ExchangeContext(ctx, m, resolver+":53")
-	if err != nil || r == nil {
-		return false
+// Delegation is the NS delegation of a domain as published by its parent
+// zone's authoritative servers.
+type Delegation struct {
+	Hosts   []string // NS host names, without the trailing dot
+	Glue    []string // glue A/AAAA addresses for the NS hosts
+	NSTTL   uint32
+	GlueTTL uint32
+}
+
+// walkRetry is how long a referral walk that failed for want of an answer
+// from the authoritative servers is remembered before it is tried again.
+// Failures to look up the servers' addresses through a resolver are not
+// remembered, since another resolver may well succeed.
+const walkRetry = 30 * time.Second
+
+// Referral walks are shared by all resolvers that report the same parent
+// NS set, so the authoritative servers see one walk per domain rather than
+// one per resolver. Concurrent callers wait for the walk in progress. Each
+// caller looks up the parent NS hosts through its own resolver first.
+var delegationCache struct {
+	sync.Mutex
+	m map[string]*cachedDelegation
+}
+
+type cachedDelegation struct {
+	done    chan struct{}
+	d       *Delegation
+	err     error
+	expires time.Time // zero for definitive results
+}
+
+// DiscoverNS finds the delegation of domain. It asks the resolver for the NS
+// records of the closest enclosing zone, then queries that zone's servers
+// directly and follows their referrals down to domain. Definitive results
+// are cached for the run; failed walks are retried after walkRetry. When the
+// servers cannot be reached from the scanner the failure has class local,
+// which says nothing about the resolver.
+func DiscoverNS(ctx context.Context, network, resolver, domain string, timeout time.Duration, ignoreRcodes []int) (*Delegation, error) {
+	domain = dns.Fqdn(strings.ToLower(domain))
+	zone, hosts, err := parentNS(ctx, network, resolver, domain, timeout, ignoreRcodes)
+	if err != nil {
+		return nil, err
 	}
-	// SERVFAIL means the resolver couldn't reach the tunnel server
-	return r.Rcode != dns.RcodeServerFailure
+
+	addrs := lookupHosts(ctx, network, resolver, hosts, timeout)
+	if len(addrs) == 0 {
+		return nil, noAddrsFailure(zone)
+	}
+
+	sort.Strings(hosts)
+	key := domain + "|" + strings.Join(hosts, ",")
+	for {
+		delegationCache.Lock()
+		if delegationCache.m == nil {
+			delegationCache.m = make(map[string]*cachedDelegation)
+		}
+		c := delegationCache.m[key]
+		if c != nil && !c.expires.IsZero() && time.Now().After(c.expires) {
+			c = nil
+		}
+		if c == nil {
+			c = &cachedDelegation{done: make(chan struct{})}
+			delegationCache.m[key] = c
+			delegationCache.Unlock()
+			return c.walk(ctx, key, network, resolver, zone, hosts, addrs, domain, timeout)
+		}
+		delegationCache.Unlock()
+
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if c.d != nil || c.err != nil {
+			return c.d, copyFailure(c.err)
+		}
+		// The walk was interrupted or failed through the walker's
+		// resolver; try it ourselves
+	}
+}
+
+// copyFailure returns a copy of a cached *Failure, which the caller may
+// then fill in as its own.
+func copyFailure(err error) error {
+	if f, ok := err.(*Failure); ok {
+		cp := *f
+		return &cp
+	}
+	return err
+}
+
+// walk runs the referral walk for c's key and publishes the result.
+func (c *cachedDelegation) walk(ctx context.Context, key, network, resolver, zone string, hosts, addrs []string, domain string, timeout time.Duration) (*Delegation, error) {
+	defer close(c.done)
+	d, lookupFailed, err := walkReferrals(ctx, network, resolver, zone, hosts, addrs, domain, timeout)
+	f, _ := err.(*Failure)
+	switch {
+	case ctx.Err() != nil, lookupFailed:
+		delegationCache.Lock()
+		delete(delegationCache.m, key)
+		delegationCache.Unlock()
+		return d, err
+	case err == nil, f != nil && f.Class == ClassNoDelegation:
+	default:
+		c.expires = time.Now().Add(walkRetry)
+	}
+	c.d, c.err = d, err
+	return d, copyFailure(err)
+}
+
+// parentNS asks the resolver for the NS records of domain's closest
+// enclosing zone, skipping names below that are not zone cuts.
+func parentNS(ctx context.Context, network, resolver, domain string, timeout time.Duration, ignoreRcodes []int) (string, []string, error) {
+	for zone := parentZone(domain); zone != ""; zone = parentZone(zone) {
+		hosts, err := QueryNS(ctx, network, resolver, zone, timeout, ignoreRcodes)
+		if err == nil {
+			return zone, hosts, nil
+		}
+		f, ok := err.(*Failure)
+		if !ok || f.Class != ClassEmptyAnswer && f.Rcode != "NXDOMAIN" {
+			f = newFailure("ns-discovery", err)
+			f.Stage = "ns-discovery"
+			return "", nil, f
+		}
+	}
+	return "", nil, &Failure{Stage: "ns-discovery", Class: ClassNoDelegation}
+}
+
+// parentZone returns the name with its first label removed, or "" for the
+// root.
+func parentZone(name string) string {
+	if name == "." {
+		return ""
+	}
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// walkReferrals queries the servers of zone at addrs for domain's NS records
+// and follows referrals to deeper zones until it reaches domain's
+// delegation. Servers of deeper zones without glue are looked up through
+// the resolver; lookupFailed reports that this failed.
+func walkReferrals(ctx context.Context, network, resolver, zone string, hosts, addrs []string, domain string, timeout time.Duration) (d *Delegation, lookupFailed bool, err error) {
+	for i := 0; i < maxReferrals; i++ {
+		if len(addrs) == 0 {
+			addrs = lookupHosts(ctx, network, resolver, hosts, timeout)
+		}
+		if len(addrs) == 0 {
+			return nil, true, noAddrsFailure(zone)
+		}
+		r, err := queryServers(ctx, addrs, domain, timeout)
+		if err != nil {
+			return nil, false, err
+		}
+
+		d, cut := referral(r, domain)
+		if d == nil || cut == zone || !dns.IsSubDomain(zone, cut) {
+			// An authoritative answer without NS records means domain is
+			// not delegated.
+			f := &Failure{Stage: "ns-discovery", Class: ClassNoDelegation}
+			if r.Rcode != dns.RcodeSuccess {
+				f.Rcode = dns.RcodeToString[r.Rcode]
+			}
+			return nil, false, f
+		}
+		if cut == domain {
+			return d, false, nil
+		}
+		// Referral to an intermediate zone between zone and domain
+		zone, hosts, addrs = cut, d.Hosts, d.Glue
+	}
+	return nil, false, &Failure{Stage: "ns-discovery", Class: ClassNoDelegation, Err: "too many referrals"}
+}
+
+// noAddrsFailure reports that the servers of zone could not be looked up
+// through the resolver.
+func noAddrsFailure(zone string) *Failure {
+	return &Failure{Stage: "ns-discovery", Class: ClassNetwork, Err: "no addresses for servers of " + zone}
+}
+
+// referral extracts the NS records closest to domain from a response, from
+// the answer section if the server is authoritative for domain itself, else
+// from the authority section of a referral. It returns the zone cut they
+// belong to.
+func referral(r *dns.Msg, domain string) (*Delegation, string) {
+	var d Delegation
+	var cut string
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			ns, ok := rr.(*dns.NS)
+			if !ok || !dns.IsSubDomain(ns.Hdr.Name, domain) {
+				continue
+			}
+			owner := strings.ToLower(ns.Hdr.Name)
+			if cut != "" && owner != cut {
+				continue
+			}
+			cut = owner
+			d.Hosts = append(d.Hosts, strings.TrimSuffix(strings.ToLower(ns.Ns), "."))
+			d.NSTTL = ns.Hdr.Ttl
+		}
+		if cut != "" {
+			break
+		}
+	}
+	if cut == "" {
+		return nil, ""
+	}
+
+	inDelegation := make(map[string]bool, len(d.Hosts))
+	for _, h := range d.Hosts {
+		inDelegation[h+"."] = true
+	}
+	for _, rr := range r.Extra {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		if inDelegation[strings.ToLower(rr.Header().Name)] {
+			d.Glue = append(d.Glue, ip.String())
+			d.GlueTTL = rr.Header().Ttl
+		}
+	}
+	return &d, cut
+}
+
+// lookupHosts resolves NS host names to their IPv4 and then their IPv6
+// addresses through the resolver.
+func lookupHosts(ctx context.Context, network, resolver string, hosts []string, timeout time.Duration) []string {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, h := range hosts {
+			r, err := query(ctx, network, resolver, h, qtype, timeout, nil)
+			if err != nil {
+				continue
+			}
+			for _, rr := range r.Answer {
+				switch a := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, a.A.String())
+				case *dns.AAAA:
+					addrs = append(addrs, a.AAAA.String())
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// queryServers sends a non-recursive NS query for domain to each server in
+// turn until one replies, retrying over TCP if the reply is truncated.
+func queryServers(ctx context.Context, servers []string, domain string, timeout time.Duration) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeNS)
+	m.RecursionDesired = false
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	var lastErr error
+	for _, s := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		addr := net.JoinHostPort(s, "53")
+		c := &dns.Client{Net: "udp", Timeout: timeout}
+		r, _, err := c.ExchangeContext(ctx, m, addr)
+		if err == nil && r.Truncated {
+			c.Net = "tcp"
+			r, _, err = c.ExchangeContext(ctx, m, addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			lastErr = rcodeFailure("ns-discovery", r.Rcode)
+			continue
+		}
+		return r, nil
+	}
+	f := newFailure("ns-discovery", lastErr)
+	f.Stage = "ns-discovery"
+	if f.Class == ClassNetwork || f.Class == ClassTimeout {
+		// No server answered the scanner itself; the resolver is not to blame
+		f.Class = ClassLocal
+	}
+	return nil, f
 }
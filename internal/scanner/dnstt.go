@@ -0,0 +1,611 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/miekg/dns"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// Protocol constants of dnstt-client, which the embedded client must match
+// for dnstt-server to accept it.
+const (
+	dnsttPadding     = 3 // random bytes in a query carrying a packet
+	dnsttPollPadding = 8 // random bytes in an empty poll query
+	dnsttQueueSize   = 128
+	dnsttInitPoll    = 500 * time.Millisecond
+	dnsttMaxPoll     = 10 * time.Second
+	dnsttIdleTimeout = 2 * time.Minute
+
+	// dnsttQueryTimeout is how long a query may go unanswered before it
+	// counts as lost. dnstt-server holds a query for up to a second waiting
+	// for data to send.
+	dnsttQueryTimeout = 3 * time.Second
+
+	noiseMaxMessage   = 65535
+	noiseMaxPlaintext = noiseMaxMessage - 16 // ChaChaPoly tag
+)
+
+var dnsttPrologue = []byte("dnstt 2020-04-13")
+
+// ParseDnsttPubkey decodes a dnstt server public key given in hex.
+func ParseDnsttPubkey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid dnstt pubkey %q (want 64 hex digits)", s)
+	}
+	return key, nil
+}
+
+// DnsttSession runs the dnstt client in process: the session is carried by
+// DNS queries sent from this process, and also records what it saw of the
+// resolver.
+func DnsttSession(domain string, pubkey []byte) DialSession {
+	return func(ctx context.Context, t Target, timeout time.Duration) (TunnelSession, error) {
+		sess, err := dialDnstt(ctx, t, domain, pubkey, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return sess, nil
+	}
+}
+
+// dnsttSession is an established dnstt tunnel: smux over Noise over KCP over
+// DNS queries to one resolver. Its Dial opens a stream to the server's
+// upstream, which is usually a SOCKS proxy.
+type dnsttSession struct {
+	conn *dnsttConn
+	kcp  *kcp.UDPSession
+	mux  *smux.Session
+}
+
+// dialDnstt starts a session through t and completes the Noise handshake
+// with the server, which takes several round trips through the resolver.
+func dialDnstt(ctx context.Context, t Target, domain string, pubkey []byte, timeout time.Duration) (*dnsttSession, error) {
+	domain = dns.Fqdn(domain)
+	mtu := dnsttMTU(domain)
+
+	network, resolver := resolverFor(t, "udp")
+	conn := newDnsttConn(network, resolver, domain, min(timeout, dnsttQueryTimeout))
+	k, err := kcp.NewConn2(conn.remote, nil, 0, 0, conn)
+	if err != nil {
+		conn.Close()
+		return nil, newFailure("client", err)
+	}
+	s := &dnsttSession{conn: conn, kcp: k}
+	k.SetStreamMode(true)
+	k.SetNoDelay(0, 0, 0, 1)
+	k.SetWindowSize(dnsttQueueSize/2, dnsttQueueSize/2)
+	if !k.SetMtu(mtu) {
+		s.Close()
+		return nil, &Failure{Stage: "client", Class: ClassNetwork, Err: fmt.Sprintf("domain %s leaves no room for packets", domain)}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		k.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { k.Close() })
+	rw, err := noiseClient(k, pubkey)
+	if !stop() || err != nil {
+		s.Close()
+		if err == nil || ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, newFailure("client", err)
+	}
+	k.SetDeadline(time.Time{})
+
+	cfg := smux.DefaultConfig()
+	cfg.Version = 2
+	cfg.KeepAliveTimeout = dnsttIdleTimeout
+	cfg.MaxStreamBuffer = 1 << 20
+	s.mux, err = smux.Client(rw, cfg)
+	if err != nil {
+		s.Close()
+		return nil, newFailure("client", err)
+	}
+	return s, nil
+}
+
+func (s *dnsttSession) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// DialContext opens a stream, giving up when ctx is done. Opening a stream
+// sends a frame, which blocks while the session's send window is full.
+func (s *dnsttSession) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type opened struct {
+		st  *smux.Stream
+		err error
+	}
+	ch := make(chan opened, 1)
+	go func() {
+		st, err := s.mux.OpenStream()
+		ch <- opened{st, err}
+	}()
+	select {
+	case o := <-ch:
+		if o.err != nil {
+			return nil, o.err
+		}
+		return o.st, nil
+	case <-ctx.Done():
+		go func() {
+			if o := <-ch; o.st != nil {
+				o.st.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *dnsttSession) Close() error {
+	if s.mux != nil {
+		s.mux.Close()
+	}
+	s.kcp.Close()
+	return s.conn.Close()
+}
+
+// AddMetrics records the DNS queries the session sent, the fraction of
+// those that finished which went unanswered, and KCP's smoothed round trip
+// through the resolver and server.
+func (s *dnsttSession) AddMetrics(m Metrics) {
+	answered, lost := s.conn.answered.Load(), s.conn.lost.Load()
+	m["tunnel_queries"] = float64(s.conn.sent.Load())
+	if answered+lost > 0 {
+		m["tunnel_loss"] = roundMs(float64(lost) / float64(answered+lost))
+	}
+	m["tunnel_srtt_ms"] = float64(s.kcp.GetSRTT())
+}
+
+// dnsttMTU is the largest KCP packet that fits in one query name under
+// domain, as dnstt-client computes it.
+func dnsttMTU(domain string) int {
+	capacity := 255 - 1
+	for _, label := range dns.SplitDomainName(domain) {
+		capacity -= len(label) + 1
+	}
+	capacity = capacity * 63 / 64 // each 63-byte label costs a length byte
+	capacity = capacity * 5 / 8   // base32
+	return capacity - 8 - 1 - dnsttPadding - 1
+}
+
+// dnsttAddr names the resolver side of a dnsttConn for KCP.
+type dnsttAddr string
+
+func (a dnsttAddr) Network() string { return "dnstt" }
+func (a dnsttAddr) String() string  { return string(a) }
+
+// dnsttConn carries KCP packets in DNS queries and TXT answers. Writes are
+// queued and sent one per query; since the server can only send when asked,
+// empty queries poll for data, right away after an answer that had some and
+// with a growing delay otherwise.
+type dnsttConn struct {
+	ctx               context.Context
+	cancel            context.CancelFunc
+	network, resolver string
+	domain            string
+	timeout           time.Duration
+	remote            dnsttAddr
+	clientID          [8]byte
+	dot               *dotStream // for DoT resolvers
+
+	in   chan []byte
+	out  chan []byte
+	poll chan struct{}
+
+	sent, answered, lost atomic.Int64
+}
+
+func newDnsttConn(network, resolver, domain string, timeout time.Duration) *dnsttConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &dnsttConn{
+		ctx:      ctx,
+		cancel:   cancel,
+		network:  network,
+		resolver: resolver,
+		domain:   domain,
+		timeout:  timeout,
+		remote:   dnsttAddr(resolver),
+		in:       make(chan []byte, dnsttQueueSize),
+		out:      make(chan []byte, dnsttQueueSize),
+		poll:     make(chan struct{}, 16),
+	}
+	if network == "dot" {
+		c.dot = &dotStream{resolver: resolver, timeout: timeout}
+	}
+	rand.Read(c.clientID[:])
+	go c.sendLoop()
+	return c
+}
+
+func (c *dnsttConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case b := <-c.in:
+		return copy(p, b), c.remote, nil
+	case <-c.ctx.Done():
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo queues p for sending and drops it if the queue is full, as a busy
+// UDP socket would.
+func (c *dnsttConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	select {
+	case c.out <- bytes.Clone(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func (c *dnsttConn) Close() error {
+	c.cancel()
+	if c.dot != nil {
+		c.dot.close()
+	}
+	return nil
+}
+
+func (c *dnsttConn) LocalAddr() net.Addr                { return dnsttAddr("local") }
+func (c *dnsttConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dnsttConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dnsttConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *dnsttConn) sendLoop() {
+	delay := dnsttInitPoll
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		var p []byte
+		expired := false
+		select {
+		case p = <-c.out:
+		default:
+			select {
+			case p = <-c.out:
+			case <-c.poll:
+			case <-timer.C:
+				expired = true
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		if len(p) > 0 {
+			// A packet does the job of a pending poll.
+			select {
+			case <-c.poll:
+			default:
+			}
+		}
+		if expired {
+			delay = min(2*delay, dnsttMaxPoll)
+		} else {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			delay = dnsttInitPoll
+		}
+		timer.Reset(delay)
+
+		go c.query(c.name(p))
+	}
+}
+
+// name encodes p in a query name: client ID, a padding length byte and
+// random padding that keeps the name uncached, then the length-prefixed
+// packet, all in base32 labels under the domain.
+func (c *dnsttConn) name(p []byte) string {
+	var buf bytes.Buffer
+	buf.Write(c.clientID[:])
+	n := dnsttPadding
+	if len(p) == 0 {
+		n = dnsttPollPadding
+	}
+	buf.WriteByte(byte(224 + n))
+	io.CopyN(&buf, rand.Reader, int64(n))
+	if len(p) > 0 {
+		buf.WriteByte(byte(len(p)))
+		buf.Write(p)
+	}
+	enc := strings.ToLower(payloadEncoding.EncodeToString(buf.Bytes()))
+	var labels []string
+	for len(enc) > 63 {
+		labels = append(labels, enc[:63])
+		enc = enc[63:]
+	}
+	return strings.Join(append(labels, enc, c.domain), ".")
+}
+
+func (c *dnsttConn) query(name string) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	m.RecursionDesired = true
+	m.SetEdns0(4096, false)
+
+	// DoH queries share dohClient's connections; DoT ones the session's
+	// stream, as dnstt-client does, so neither pays a handshake per query.
+	c.sent.Add(1)
+	var r *dns.Msg
+	var err error
+	if c.dot != nil {
+		r, err = c.dot.exchange(c.ctx, m)
+	} else {
+		r, err = exchange(c.ctx, c.network, c.resolver, m, c.timeout, nil)
+	}
+	if c.ctx.Err() != nil {
+		return
+	}
+	payload, ok := dnsttPayload(r, c.domain)
+	if err != nil || !ok {
+		c.lost.Add(1)
+		return
+	}
+	c.answered.Add(1)
+
+	got := false
+	for len(payload) >= 2 {
+		n := int(binary.BigEndian.Uint16(payload))
+		if len(payload) < 2+n {
+			break
+		}
+		select {
+		case c.in <- payload[2 : 2+n]:
+			got = true
+		default:
+		}
+		payload = payload[2+n:]
+	}
+	if got {
+		select {
+		case c.poll <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dotStream sends the queries of a session over one DoT connection, with
+// any number in flight, and matches answers to them by ID. The connection is
+// dialled on first use and again after it fails.
+type dotStream struct {
+	resolver string
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	conn    *dns.Conn
+	pending map[uint16]chan *dns.Msg // of conn; closed when it fails
+	closed  bool
+}
+
+var errStreamClosed = errors.New("DoT connection closed")
+
+func (s *dotStream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if s.conn == nil {
+		c := &dns.Client{Net: "tcp-tls", TLSConfig: dotConfig(s.resolver), Timeout: s.timeout}
+		conn, err := c.DialContext(ctx, s.resolver)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		s.conn = conn
+		s.pending = make(map[uint16]chan *dns.Msg)
+		go s.readLoop(conn, s.pending)
+	}
+	conn, pending := s.conn, s.pending
+	m.Id = dns.Id()
+	for pending[m.Id] != nil {
+		m.Id = dns.Id()
+	}
+	ch := make(chan *dns.Msg, 1)
+	pending[m.Id] = ch
+	conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	err := conn.WriteMsg(m)
+	s.mu.Unlock()
+	if err != nil {
+		s.fail(conn, pending)
+		return nil, err
+	}
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, errStreamClosed
+		}
+		return r, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(pending, m.Id)
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop hands the answers read from conn to the queries waiting for them.
+func (s *dotStream) readLoop(conn *dns.Conn, pending map[uint16]chan *dns.Msg) {
+	for {
+		r, err := conn.ReadMsg()
+		if err != nil {
+			s.fail(conn, pending)
+			return
+		}
+		s.mu.Lock()
+		if ch := pending[r.Id]; ch != nil {
+			delete(pending, r.Id)
+			ch <- r
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fail closes conn and fails the queries waiting on it, so that the next
+// query dials anew.
+func (s *dotStream) fail(conn *dns.Conn, pending map[uint16]chan *dns.Msg) {
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	for id, ch := range pending {
+		delete(pending, id)
+		close(ch)
+	}
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func (s *dotStream) close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// dnsttPayload returns the raw bytes of the single TXT answer a dnstt server
+// sends, which hold length-prefixed packets.
+func dnsttPayload(r *dns.Msg, domain string) ([]byte, bool) {
+	if r == nil || !r.Response || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		return nil, false
+	}
+	rr, ok := r.Answer[0].(*dns.TXT)
+	if !ok || !dns.IsSubDomain(domain, rr.Hdr.Name) {
+		return nil, false
+	}
+	// TXT strings are kept escaped, so take the bytes from the wire form.
+	buf := make([]byte, dns.Len(rr))
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, false
+	}
+	rdata := buf[off-int(rr.Hdr.Rdlength) : off]
+	var payload []byte
+	for len(rdata) > 0 {
+		n := int(rdata[0])
+		if len(rdata) < 1+n {
+			return nil, false
+		}
+		payload = append(payload, rdata[1:1+n]...)
+		rdata = rdata[1+n:]
+	}
+	return payload, true
+}
+
+// noiseClient runs the Noise_NK handshake of dnstt over rw and returns the
+// encrypted channel.
+func noiseClient(rw io.ReadWriteCloser, pubkey []byte) (io.ReadWriteCloser, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite: noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s),
+		Pattern:     noise.HandshakeNK,
+		Initiator:   true,
+		Prologue:    dnsttPrologue,
+		PeerStatic:  pubkey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg, _, _, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeNoiseMessage(rw, msg); err != nil {
+		return nil, err
+	}
+	msg, err = readNoiseMessage(rw)
+	if err != nil {
+		return nil, err
+	}
+	payload, send, recv, err := hs.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != 0 {
+		return nil, errors.New("unexpected payload in noise handshake")
+	}
+	return &noiseConn{ReadWriteCloser: rw, send: send, recv: recv}, nil
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// noiseConn encrypts each write into one or more Noise messages and
+// decrypts them on read.
+type noiseConn struct {
+	io.ReadWriteCloser
+	send, recv *noise.CipherState
+	buf        []byte
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msg, err := readNoiseMessage(c.ReadWriteCloser)
+		if err != nil {
+			return 0, err
+		}
+		if c.buf, err = c.recv.Decrypt(nil, nil, msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), noiseMaxPlaintext)]
+		msg, err := c.send.Encrypt(nil, nil, chunk)
+		if err != nil {
+			return total, err
+		}
+		if err := writeNoiseMessage(c.ReadWriteCloser, msg); err != nil {
+			return total, err
+		}
+		total += len(chunk)
+		p = p[len(chunk):]
+	}
+	return total, nil
+}
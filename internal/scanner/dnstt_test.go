@@ -0,0 +1,645 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/miekg/dns"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+func TestDnsttMTU(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   int
+	}{
+		// (254 - 14) * 63/64 * 5/8 - 13, as dnstt-client computes it
+		{"t.example.com.", 134},
+		{"t.co.", 140},
+		{strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + ".", 25},
+	}
+	for _, tt := range tests {
+		if got := dnsttMTU(tt.domain); got != tt.want {
+			t.Errorf("dnsttMTU(%q) = %d, want %d", tt.domain, got, tt.want)
+		}
+	}
+}
+
+// decodeDnsttName returns the client ID, padding length and packet carried
+// by a query name under domain, as dnstt-server reads them.
+func decodeDnsttName(t *testing.T, name, domain string) (id []byte, padding int, packet []byte) {
+	t.Helper()
+	prefix, ok := strings.CutSuffix(name, "."+domain)
+	if !ok {
+		t.Fatalf("%q is not under %q", name, domain)
+	}
+	for _, label := range strings.Split(prefix, ".") {
+		if len(label) > 63 {
+			t.Fatalf("label of %d characters in %q", len(label), name)
+		}
+	}
+	raw, err := payloadEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(prefix, ".", "")))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", name, err)
+	}
+	if len(raw) < 9 || raw[8] < 224 {
+		t.Fatalf("no padding length in %x", raw)
+	}
+	padding = int(raw[8]) - 224
+	rest := raw[9+padding:]
+	if len(rest) > 0 {
+		if int(rest[0]) != len(rest)-1 {
+			t.Fatalf("packet length %d, have %d bytes", rest[0], len(rest)-1)
+		}
+		packet = rest[1:]
+	}
+	return raw[:8], padding, packet
+}
+
+func TestDnsttConnName(t *testing.T) {
+	const domain = "t.example.com."
+	c := &dnsttConn{domain: domain}
+	copy(c.clientID[:], "clientid")
+	mtu := dnsttMTU(domain)
+
+	for _, size := range []int{0, 1, 40, mtu} {
+		p := make([]byte, size)
+		rand.Read(p)
+		name := c.name(p)
+		if _, ok := dns.IsDomainName(name); !ok || len(name) > 254 {
+			t.Errorf("%d-byte packet: invalid name %q", size, name)
+			continue
+		}
+		id, padding, packet := decodeDnsttName(t, name, domain)
+		if string(id) != "clientid" {
+			t.Errorf("%d-byte packet: client ID %q", size, id)
+		}
+		wantPadding := dnsttPadding
+		if size == 0 {
+			wantPadding = dnsttPollPadding
+		}
+		if padding != wantPadding {
+			t.Errorf("%d-byte packet: padding %d, want %d", size, padding, wantPadding)
+		}
+		if !bytes.Equal(packet, p) {
+			t.Errorf("%d-byte packet: got %x back", size, packet)
+		}
+	}
+
+	// One byte more than the MTU must not fit
+	if name := c.name(make([]byte, mtu+1)); len(name) <= 254 {
+		if _, ok := dns.IsDomainName(name); ok {
+			t.Errorf("packet of MTU+1 bytes fits in %q", name)
+		}
+	}
+}
+
+// txtEscape escapes b for a TXT string the way miekg/dns keeps them.
+func txtEscape(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// dnsttAnswer returns a reply to q carrying payload in one TXT record of
+// 255-byte strings, as dnstt-server sends it.
+func dnsttAnswer(q *dns.Msg, payload []byte) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	var strs []string
+	for len(payload) > 255 {
+		strs = append(strs, txtEscape(payload[:255]))
+		payload = payload[255:]
+	}
+	strs = append(strs, txtEscape(payload))
+	r.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: strs,
+	}}
+	return r
+}
+
+// wire sends r through its wire form, as if it came from a server.
+func wire(t *testing.T, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	b, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDnsttPayload(t *testing.T) {
+	const domain = "t.example.com."
+	q := new(dns.Msg)
+	q.SetQuestion("abc."+domain, dns.TypeTXT)
+
+	// Every byte value, including quotes, backslashes and non-printables
+	payload := make([]byte, 600)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	got, ok := dnsttPayload(wire(t, dnsttAnswer(q, payload)), domain)
+	if !ok || !bytes.Equal(got, payload) {
+		t.Errorf("payload: ok=%v, got %d bytes, want %d", ok, len(got), len(payload))
+	}
+	if got, ok := dnsttPayload(wire(t, dnsttAnswer(q, nil)), domain); !ok || len(got) != 0 {
+		t.Errorf("empty payload: ok=%v, got %x", ok, got)
+	}
+	mixed := dnsttAnswer(q, []byte("data"))
+	mixed.Answer[0].Header().Name = "abc.T.Example.com."
+	if got, ok := dnsttPayload(wire(t, mixed), domain); !ok || string(got) != "data" {
+		t.Errorf("mixed case owner: ok=%v, got %q", ok, got)
+	}
+
+	bad := map[string]func(r *dns.Msg){
+		"servfail":    func(r *dns.Msg) { r.Rcode = dns.RcodeServerFailure },
+		"not a reply": func(r *dns.Msg) { r.Response = false },
+		"no answer":   func(r *dns.Msg) { r.Answer = nil },
+		"two answers": func(r *dns.Msg) { r.Answer = append(r.Answer, dns.Copy(r.Answer[0])) },
+		"outside":     func(r *dns.Msg) { r.Answer[0].Header().Name = "abc.example.org." },
+		"not txt": func(r *dns.Msg) {
+			r.Answer[0] = &dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(1, 2, 3, 4)}
+		},
+		"nil message": nil,
+	}
+	for name, mutate := range bad {
+		var r *dns.Msg
+		if mutate != nil {
+			r = dnsttAnswer(q, []byte("data"))
+			mutate(r)
+			r = wire(t, r)
+		}
+		if _, ok := dnsttPayload(r, domain); ok {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+var testCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// noiseServer is the responder side of noiseClient, as in dnstt-server.
+func noiseServer(rw io.ReadWriteCloser, key noise.DHKey) (io.ReadWriteCloser, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   testCipherSuite,
+		Pattern:       noise.HandshakeNK,
+		Prologue:      dnsttPrologue,
+		StaticKeypair: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := readNoiseMessage(rw)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err := hs.ReadMessage(nil, msg); err != nil {
+		return nil, err
+	}
+	msg, recv, send, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeNoiseMessage(rw, msg); err != nil {
+		return nil, err
+	}
+	return &noiseConn{ReadWriteCloser: rw, send: send, recv: recv}, nil
+}
+
+func TestNoiseRoundTrip(t *testing.T) {
+	key, err := testCipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	go func() {
+		rw, err := noiseServer(s, key)
+		if err != nil {
+			return
+		}
+		// Echo, so both directions are covered
+		io.Copy(rw, rw)
+	}()
+
+	rw, err := noiseClient(c, key.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Larger than one Noise message, so Write has to split it
+	msg := make([]byte, noiseMaxPlaintext+1000)
+	rand.Read(msg)
+	go rw.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(rw, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("echoed data differs")
+	}
+}
+
+func TestNoiseWrongKey(t *testing.T) {
+	key, _ := testCipherSuite.GenerateKeypair(rand.Reader)
+	other, _ := testCipherSuite.GenerateKeypair(rand.Reader)
+	c, s := net.Pipe()
+	defer c.Close()
+
+	go noiseClient(c, other.Public)
+	_, err := noiseServer(s, key)
+	s.Close()
+	if err == nil {
+		t.Error("handshake with the wrong server key succeeded")
+	}
+}
+
+func TestNoiseFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range [][]byte{{}, []byte("x"), bytes.Repeat([]byte{0xff}, noiseMaxMessage)} {
+		buf.Reset()
+		if err := writeNoiseMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+		if n := binary.BigEndian.Uint16(buf.Bytes()); int(n) != len(msg) || buf.Len() != 2+len(msg) {
+			t.Errorf("%d-byte message framed as length %d in %d bytes", len(msg), n, buf.Len())
+		}
+		got, err := readNoiseMessage(&buf)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%d-byte message: read %d bytes, %v", len(msg), len(got), err)
+		}
+	}
+	if _, err := readNoiseMessage(bytes.NewReader([]byte{0, 5, 1, 2})); err == nil {
+		t.Error("short message read without error")
+	}
+}
+
+// fakeDnsttServer answers dnstt queries like dnstt-server: packets in query
+// names go to a KCP listener, and packets it sends back ride in the TXT
+// answers of later queries. Streams opened over it are echoed.
+type fakeDnsttServer struct {
+	domain string
+	key    noise.DHKey
+	addr   string
+
+	in     chan fakePacket
+	done   chan struct{}
+	mu     sync.Mutex
+	out    map[dnsttAddr]chan []byte
+	dnsSrv *dns.Server
+	ln     *kcp.Listener
+}
+
+type fakePacket struct {
+	b    []byte
+	from dnsttAddr
+}
+
+func startFakeDnsttServer(t *testing.T, domain string) *fakeDnsttServer {
+	t.Helper()
+	key, err := testCipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDnsttServer{
+		domain: domain,
+		key:    key,
+		in:     make(chan fakePacket, dnsttQueueSize),
+		done:   make(chan struct{}),
+		out:    make(map[dnsttAddr]chan []byte),
+	}
+
+	s.ln, err = kcp.ServeConn(nil, 0, 0, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.accept()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = pc.LocalAddr().String()
+	s.dnsSrv = &dns.Server{PacketConn: pc, Handler: s}
+	go s.dnsSrv.ActivateAndServe()
+
+	t.Cleanup(func() {
+		close(s.done)
+		s.dnsSrv.Shutdown()
+		s.ln.Close()
+	})
+	return s
+}
+
+func (s *fakeDnsttServer) target() Target {
+	host, port, _ := net.SplitHostPort(s.addr)
+	var p int
+	fmt.Sscan(port, &p)
+	return Target{IP: host, Port: p}
+}
+
+// serveDoT also serves s over DoT, with a self-signed certificate, and
+// returns the target for it and a count of the connections accepted.
+func (s *fakeDnsttServer) serveDoT(t *testing.T) (Target, *atomic.Int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingListener{Listener: ln}
+	srv := &dns.Server{Listener: counted, Handler: s, MaxTCPQueries: -1}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return Target{IP: "127.0.0.1", Port: addr.Port, URL: "tls://" + addr.String()}, &counted.n
+}
+
+type countingListener struct {
+	net.Listener
+	n atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.n.Add(1)
+	}
+	return c, err
+}
+
+func (s *fakeDnsttServer) accept() {
+	for {
+		conn, err := s.ln.AcceptKCP()
+		if err != nil {
+			return
+		}
+		conn.SetStreamMode(true)
+		conn.SetNoDelay(0, 0, 0, 1)
+		conn.SetWindowSize(dnsttQueueSize/2, dnsttQueueSize/2)
+		conn.SetMtu(1000)
+		go func() {
+			defer conn.Close()
+			rw, err := noiseServer(conn, s.key)
+			if err != nil {
+				return
+			}
+			cfg := smux.DefaultConfig()
+			cfg.Version = 2
+			mux, err := smux.Server(rw, cfg)
+			if err != nil {
+				return
+			}
+			defer mux.Close()
+			for {
+				st, err := mux.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer st.Close()
+					io.Copy(st, st)
+				}()
+			}
+		}()
+	}
+}
+
+func (s *fakeDnsttServer) queue(addr dnsttAddr) chan []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.out[addr]
+	if q == nil {
+		q = make(chan []byte, dnsttQueueSize)
+		s.out[addr] = q
+	}
+	return q
+}
+
+func (s *fakeDnsttServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	name := strings.ToLower(q.Question[0].Name)
+	prefix, ok := strings.CutSuffix(name, "."+s.domain)
+	if !ok {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		w.WriteMsg(r)
+		return
+	}
+	raw, err := payloadEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(prefix, ".", "")))
+	if err != nil || len(raw) < 9 || raw[8] < 224 || len(raw) < 9+int(raw[8]-224) {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		w.WriteMsg(r)
+		return
+	}
+	from := dnsttAddr(hex.EncodeToString(raw[:8]))
+	for rest := raw[9+int(raw[8]-224):]; len(rest) > 0 && len(rest) >= 1+int(rest[0]); rest = rest[1+int(rest[0]):] {
+		s.in <- fakePacket{bytes.Clone(rest[1 : 1+int(rest[0])]), from}
+	}
+
+	// Hold the query briefly for something to send, as dnstt-server does
+	var payload []byte
+	q2 := s.queue(from)
+	timer := time.NewTimer(50 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case p := <-q2:
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(p)))
+		payload = append(payload, p...)
+	case <-timer.C:
+	case <-s.done:
+	}
+	for len(payload) < 2000 {
+		select {
+		case p := <-q2:
+			payload = binary.BigEndian.AppendUint16(payload, uint16(len(p)))
+			payload = append(payload, p...)
+			continue
+		default:
+		}
+		break
+	}
+	w.WriteMsg(dnsttAnswer(q, payload))
+}
+
+func (s *fakeDnsttServer) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-s.in:
+		return copy(p, pkt.b), pkt.from, nil
+	case <-s.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (s *fakeDnsttServer) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case s.queue(addr.(dnsttAddr)) <- bytes.Clone(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func (s *fakeDnsttServer) Close() error                       { return nil }
+func (s *fakeDnsttServer) LocalAddr() net.Addr                { return dnsttAddr("server") }
+func (s *fakeDnsttServer) SetDeadline(t time.Time) error      { return nil }
+func (s *fakeDnsttServer) SetReadDeadline(t time.Time) error  { return nil }
+func (s *fakeDnsttServer) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestDnsttSessionRoundTrip(t *testing.T) {
+	srv := startFakeDnsttServer(t, "t.test.")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sess, err := dialDnstt(ctx, srv.target(), "t.test", srv.key.Public, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	conn, err := sess.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+
+	// Several KCP packets' worth each way
+	msg := make([]byte, 20000)
+	rand.Read(msg)
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("echoed data differs")
+	}
+
+	m := Metrics{}
+	sess.AddMetrics(m)
+	if n, _ := m.Float("tunnel_queries"); n < 2 {
+		t.Errorf("tunnel_queries = %v", m["tunnel_queries"])
+	}
+	if _, ok := m["tunnel_loss"]; !ok {
+		t.Error("no tunnel_loss")
+	}
+}
+
+func TestDnsttSessionDoT(t *testing.T) {
+	InsecureTLS = true
+	defer func() { InsecureTLS = false }()
+	srv := startFakeDnsttServer(t, "t.test.")
+	target, conns := srv.serveDoT(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sess, err := dialDnstt(ctx, target, "t.test", srv.key.Public, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	conn, err := sess.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	msg := make([]byte, 4000)
+	rand.Read(msg)
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("echoed data differs")
+	}
+
+	m := Metrics{}
+	sess.AddMetrics(m)
+	if n, _ := m.Float("tunnel_queries"); n < 2 {
+		t.Errorf("tunnel_queries = %v", m["tunnel_queries"])
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d DoT connections for one session, want 1", n)
+	}
+}
+
+func TestDnsttWrongPubkey(t *testing.T) {
+	srv := startFakeDnsttServer(t, "t.test.")
+	other, _ := testCipherSuite.GenerateKeypair(rand.Reader)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sess, err := dialDnstt(ctx, srv.target(), "t.test", other.Public, time.Second)
+	if err == nil {
+		sess.Close()
+		t.Fatal("session established with the wrong server key")
+	}
+	if f, ok := err.(*Failure); !ok || f.Stage != "client" {
+		t.Errorf("error %v, want a client failure", err)
+	}
+}
+
+func TestDnsttDialContextCancelled(t *testing.T) {
+	srv := startFakeDnsttServer(t, "t.test.")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sess, err := dialDnstt(ctx, srv.target(), "t.test", srv.key.Public, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	done, cancelDial := context.WithCancel(ctx)
+	cancelDial()
+	if conn, err := sess.DialContext(done, "tcp", "example.com:80"); err == nil {
+		conn.Close()
+		t.Error("DialContext with a cancelled context opened a stream")
+	}
+}
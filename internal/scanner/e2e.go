@@ -1,12 +1,13 @@
 package scanner
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"os/exec"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,116 +19,305 @@ func PortPool(base, count int) chan int {
 	return ch
 }
 
-func DnsttCheck(domain, pubkey, socksUser, socksPass, testURL string, ports chan int) CheckFunc {
-	return func(ip string, timeout time.Duration) (bool, Metrics) {
-		port := <-ports
+// Kinds of local proxy a tunnel client listens with.
+const (
+	ProxySOCKS5 = "socks5" // SOCKS5, host names resolved by the proxy
+	ProxyHTTP   = "http"   // HTTP proxy with CONNECT
+	ProxyNone   = "none"   // no proxy; the client routes traffic itself, so only its readiness is checked
+)
+
+// TunnelClient starts a tunnel client for one resolver. e2e checks then
+// fetch their test URL, or run their bench, through the proxy it listens
+// with on the local port; a client without one is only checked for readiness.
+type TunnelClient interface {
+	// Start launches the client for t with its proxy on port and returns
+	// once it can carry traffic, or after timeout. The client runs until
+	// stop is called or ctx ends.
+	Start(ctx context.Context, t Target, port int, timeout time.Duration) (stop func(), err error)
+	// Proxy is one of ProxySOCKS5, ProxyHTTP or ProxyNone.
+	Proxy() string
+}
+
+// TunnelSession is a tunnel client run in this process. Dial opens a stream
+// to the tunnel server's upstream, which is usually a SOCKS proxy.
+type TunnelSession interface {
+	Dial(network, addr string) (net.Conn, error)
+	Close() error
+	// AddMetrics records what the session saw of the resolver in m.
+	AddMetrics(m Metrics)
+}
+
+// DialSession starts a TunnelSession through t, returning once it can carry
+// traffic or ctx ends.
+type DialSession func(ctx context.Context, t Target, timeout time.Duration) (TunnelSession, error)
+
+// ClientCheck starts c for each resolver and fetches testURL through it.
+// Each worker takes a local port from ports for its client. A client with
+// ProxyNone has no proxy the scanner could fetch through, so for it only
+// handshake_ms, the time until it was ready, is recorded.
+func ClientCheck(c TunnelClient, proxyUser, proxyPass, testURL string, ports chan int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		var port int
+		select {
+		case port = <-ports:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		defer func() { ports <- port }()
 
 		start := time.Now()
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		cmd := exec.CommandContext(ctx, "dnstt-client",
-			"-udp", ip+":53",
-			"-pubkey", pubkey,
-			domain,
-			fmt.Sprintf("127.0.0.1:%d", port))
-		cmd.Stdout = io.Discard
-		cmd.Stderr = io.Discard
-		if err := cmd.Start(); err != nil {
-			return false, nil
+		stop, err := c.Start(ctx, t, port, timeout)
+		if err != nil {
+			return nil, err
 		}
-		defer func() {
-			cmd.Process.Kill()
-			cmd.Wait()
-		}()
-
-		select {
-		case <-time.After(2 * time.Second):
-		case <-ctx.Done():
-			return false, nil
+		defer stop()
+		handshake := msSince(start)
+		if c.Proxy() == ProxyNone {
+			return Metrics{"handshake_ms": handshake}, nil
 		}
 
-		if !testSOCKS(ctx, port, socksUser, socksPass, testURL) {
-			return false, nil
+		client, err := proxyClient(c.Proxy(), port, proxyUser, proxyPass)
+		if err != nil {
+			return nil, newFailure("socks", err)
+		}
+		m, err := testSOCKS(ctx, client, testURL)
+		if err != nil {
+			return nil, err
 		}
-		ms := roundMs(float64(time.Since(start).Microseconds()) / 1000.0)
-		return true, Metrics{"e2e_ms": ms}
+		m["handshake_ms"] = handshake
+		m["e2e_ms"] = msSince(start)
+		return m, nil
 	}
 }
 
-func SlipstreamCheck(domain, certPath, testURL string, ports chan int) CheckFunc {
-	return func(ip string, timeout time.Duration) (bool, Metrics) {
-		port := <-ports
-		defer func() { ports <- port }()
-
+// SessionCheck is ClientCheck for a client run in process: dial starts the
+// session, so no binary or local port is needed and every worker can hold
+// one. The test URL is fetched through the SOCKS proxy the session reaches.
+func SessionCheck(dial DialSession, socksUser, socksPass, testURL string) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
 		start := time.Now()
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		args := []string{
-			"-d", domain,
-			"-r", ip + ":53",
-			"-l", fmt.Sprintf("%d", port),
+		sess, err := dial(ctx, t, timeout)
+		if err != nil {
+			return nil, err
 		}
-		if certPath != "" {
-			args = append(args, "--cert", certPath)
+		defer sess.Close()
+		handshake := msSince(start)
+
+		client, err := socksClientVia("tunnel", sess, socksUser, socksPass)
+		if err != nil {
+			return nil, newFailure("socks", err)
 		}
-		cmd := exec.CommandContext(ctx, "slipstream-client", args...)
-		cmd.Stderr = io.Discard
-		stdoutPipe, err := cmd.StdoutPipe()
+		m, err := testSOCKS(ctx, client, testURL)
 		if err != nil {
-			return false, nil
+			return nil, err
 		}
-		if err := cmd.Start(); err != nil {
-			return false, nil
+		m["handshake_ms"] = handshake
+		m["e2e_ms"] = msSince(start)
+		sess.AddMetrics(m)
+		return m, nil
+	}
+}
+
+// DnsttClient runs dnstt-client, which supports DoH and DoT resolvers. It is
+// ready once the tunnel answers a SOCKS greeting.
+type DnsttClient struct {
+	Domain string
+	Pubkey string
+}
+
+func (c DnsttClient) Proxy() string { return ProxySOCKS5 }
+
+func (c DnsttClient) Start(ctx context.Context, t Target, port int, timeout time.Duration) (func(), error) {
+	var args []string
+	switch t.Network() {
+	case "doh":
+		args = []string{"-doh", t.URL}
+	case "dot":
+		args = []string{"-dot", t.Addr()}
+	default:
+		args = []string{"-udp", t.Addr()}
+	}
+	args = append(args, "-pubkey", c.Pubkey, c.Domain, fmt.Sprintf("127.0.0.1:%d", port))
+	return startClient(ctx, "dnstt-client", args, port, Readiness{Kind: ReadySOCKS}, timeout)
+}
+
+// SlipstreamClient runs slipstream-client, which is ready once it prints
+// "Connection ready".
+type SlipstreamClient struct {
+	Domain string
+	Cert   string // optional, for cert pinning
+}
+
+func (c SlipstreamClient) Proxy() string { return ProxySOCKS5 }
+
+func (c SlipstreamClient) Start(ctx context.Context, t Target, port int, timeout time.Duration) (func(), error) {
+	if t.URL != "" {
+		return nil, &Failure{Stage: "client", Class: ClassNetwork, Err: "slipstream does not support DoH/DoT resolvers"}
+	}
+	args := []string{
+		"-d", c.Domain,
+		"-r", t.Addr(),
+		"-l", fmt.Sprintf("%d", port),
+	}
+	if c.Cert != "" {
+		args = append(args, "--cert", c.Cert)
+	}
+	return startClient(ctx, "slipstream-client", args, port, Readiness{Kind: ReadyOutput, Match: "Connection ready"}, timeout)
+}
+
+// Ways to tell that a started tunnel client can carry traffic.
+const (
+	ReadySOCKS  = "socks"  // the local port answers a SOCKS greeting
+	ReadyPort   = "port"   // the local port accepts connections
+	ReadyOutput = "output" // a line of output contains Match
+)
+
+type Readiness struct {
+	Kind  string
+	Match string
+}
+
+// startClient runs a tunnel client binary and waits up to timeout until ready
+// says it can carry traffic on port. The client lives until stop is called or
+// ctx ends.
+func startClient(ctx context.Context, bin string, args []string, port int, ready Readiness, timeout time.Duration) (stop func(), err error) {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	// Don't wait on output that a child of the client, e.g. of a wrapper
+	// script, keeps open after the client is killed
+	cmd.WaitDelay = time.Second
+	var stderr lastLine
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+	out := &outputWatch{match: []byte(ready.Match), ready: make(chan struct{})}
+	if ready.Kind == ReadyOutput {
+		cmd.Stdout = out
+		cmd.Stderr = io.MultiWriter(&stderr, out)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, newFailure("client", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	stop = func() {
+		cmd.Process.Kill()
+		<-exited
+	}
+
+	// Stop waiting as soon as the client dies, e.g. on a bad key.
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-exited:
+			cancel()
+		case <-wctx.Done():
 		}
-		defer func() {
-			cmd.Process.Kill()
-			cmd.Wait()
-		}()
-
-		ready := make(chan struct{})
-		go func() {
-			sc := bufio.NewScanner(stdoutPipe)
-			for sc.Scan() {
-				if strings.Contains(sc.Text(), "Connection ready") {
-					close(ready)
-					break
-				}
-			}
-			// Keep draining stdout so slipstream-client doesn't get SIGPIPE
-			io.Copy(io.Discard, stdoutPipe)
-		}()
+	}()
 
+	switch ready.Kind {
+	case ReadySOCKS:
+		err = waitSOCKS(wctx, port)
+	case ReadyPort:
+		err = waitPort(wctx, port)
+	default:
 		select {
-		case <-ready:
-		case <-ctx.Done():
-			return false, nil
+		case <-out.ready:
+		case <-wctx.Done():
+			err = wctx.Err()
 		}
+	}
+	if err == nil {
+		return stop, nil
+	}
 
-		if !testSOCKS(ctx, port, "", "", testURL) {
-			return false, nil
+	died := false
+	select {
+	case <-exited:
+		died = true
+	default:
+	}
+	stop()
+	switch {
+	case ctx.Err() != nil:
+		return nil, clientFailure(ctx.Err(), &stderr)
+	case died:
+		msg := stderr.String()
+		if msg == "" {
+			msg = bin + ": " + cmd.ProcessState.String()
+		}
+		return nil, &Failure{Stage: "client", Class: ClassProcess, Err: msg}
+	}
+	return nil, clientFailure(context.DeadlineExceeded, &stderr)
+}
+
+// waitPort polls until the local port accepts a connection.
+func waitPort(ctx context.Context, port int) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-time.After(readyPoll):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		ms := roundMs(float64(time.Since(start).Microseconds()) / 1000.0)
-		return true, Metrics{"e2e_ms": ms}
 	}
 }
 
-func testSOCKS(ctx context.Context, port int, user, pass, testURL string) bool {
-	proxy := fmt.Sprintf("socks5h://127.0.0.1:%d", port)
-	if user != "" {
-		proxy = fmt.Sprintf("socks5h://%s:%s@127.0.0.1:%d", user, pass, port)
+// outputWatch closes ready once the output written to it contains match.
+// Only the unfinished last line is kept between writes.
+type outputWatch struct {
+	match []byte
+	ready chan struct{}
+
+	mu   sync.Mutex
+	line []byte
+	done bool
+}
+
+func (w *outputWatch) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return len(p), nil
+	}
+	w.line = append(w.line, p...)
+	if bytes.Contains(w.line, w.match) {
+		w.done = true
+		w.line = nil
+		close(w.ready)
+		return len(p), nil
 	}
-	cmd := exec.CommandContext(ctx, "curl",
-		"-x", proxy,
-		"-s", "-o", "/dev/null", "-w", "%{http_code}",
-		testURL)
-	output, err := cmd.Output()
-	if err != nil {
-		return false
+	if i := bytes.LastIndexByte(w.line, '\n'); i >= 0 {
+		w.line = w.line[i+1:]
+	}
+	if n := len(w.line); n > 4096 {
+		w.line = w.line[n-4096:]
+	}
+	return len(p), nil
+}
+
+// clientFailure reports a tunnel client that did not become ready in time,
+// including the last line it logged.
+func clientFailure(err error, stderr *lastLine) *Failure {
+	f := newFailure("client", err)
+	if line := stderr.String(); line != "" {
+		f.Err = line
 	}
-	return strings.TrimSpace(string(output)) == "200"
+	return f
 }
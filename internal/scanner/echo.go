@@ -0,0 +1,88 @@
+package scanner
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EchoName returns a fresh echo query name under zone. The random label keeps
+// resolvers from answering it from cache.
+func EchoName(zone string) string {
+	return "e-" + randomLabel(16) + "." + dns.Fqdn(zone)
+}
+
+func signEcho(secret []byte, name, src string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToLower(dns.Fqdn(name)) + "|" + src))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyEcho checks the TXT strings of an echo answer for name and returns
+// the source IP our server saw the query from. The answer must echo name, and
+// with a secret it must also carry a valid signature, so a middlebox cannot
+// forge it.
+func VerifyEcho(secret []byte, name string, txt []string) (string, error) {
+	fields := make(map[string]string, len(txt))
+	for _, t := range txt {
+		if k, v, ok := strings.Cut(t, "="); ok {
+			fields[k] = v
+		}
+	}
+	if fields["name"] != strings.ToLower(dns.Fqdn(name)) || net.ParseIP(fields["src"]) == nil {
+		return "", &Failure{Stage: "echo", Class: ClassUnverified, Err: "answer does not echo the query"}
+	}
+	if len(secret) > 0 && !hmac.Equal([]byte(fields["sig"]), []byte(signEcho(secret, name, fields["src"]))) {
+		return "", &Failure{Stage: "echo", Class: ClassUnverified, Err: "bad signature"}
+	}
+	return fields["src"], nil
+}
+
+// EchoCheck sends an echo query for a fresh name under domain, which must be
+// served by the serve command, and checks that the answer came from it. It
+// records the round trip and the egress IP our server saw.
+func EchoCheck(domain string, secret []byte) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		network, resolver := resolverFor(t, "udp")
+
+		start := time.Now()
+		src, err := queryEcho(ctx, network, resolver, EchoName(domain), secret, timeout)
+		if err != nil {
+			return nil, err
+		}
+		ms := msSince(start)
+		return Metrics{"echo_ms": ms, "egress_ip": src}, nil
+	}
+}
+
+// queryEcho sends an echo query for name and returns the verified source IP
+// from the answer.
+func queryEcho(ctx context.Context, network, resolver, name string, secret []byte, timeout time.Duration) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	m.RecursionDesired = true
+
+	r, err := exchange(ctx, network, resolver, m, timeout, nil)
+	if err != nil {
+		return "", newFailure("echo", err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return "", rcodeFailure("echo", r.Rcode)
+	}
+	var txt []string
+	for _, rr := range r.Answer {
+		if rec, ok := rr.(*dns.TXT); ok {
+			txt = append(txt, rec.Txt...)
+		}
+	}
+	if len(txt) == 0 {
+		return "", &Failure{Stage: "echo", Class: ClassEmptyAnswer}
+	}
+	return VerifyEcho(secret, name, txt)
+}
@@ -0,0 +1,204 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EgressTag returns the label part identifying t in egress probe names. It is
+// derived from the secret so that, given the scanned targets, the tag in a
+// logged query maps back to the resolver it was sent to, while others cannot
+// tell which resolver a logged query belongs to.
+func EgressTag(secret []byte, t Target) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t.String()))
+	return strings.ToLower(payloadEncoding.EncodeToString(mac.Sum(nil)))[:16]
+}
+
+// egressName returns an echo name for t: e-<tag>-<nonce>.<domain>. The nonce
+// keeps every query uncached.
+func egressName(domain string, secret []byte, t Target) string {
+	return "e-" + EgressTag(secret, t) + "-" + randomLabel(8) + "." + strings.TrimSuffix(domain, ".") + "."
+}
+
+// parseEgressTag returns the tag of an egress probe name, or false if name is
+// not one.
+func parseEgressTag(name string) (string, bool) {
+	label, _, _ := strings.Cut(strings.ToLower(name), ".")
+	rest, ok := strings.CutPrefix(label, "e-")
+	if !ok {
+		return "", false
+	}
+	tag, _, ok := strings.Cut(rest, "-")
+	return tag, ok && tag != ""
+}
+
+// EgressCheck sends count tagged echo queries through each resolver and
+// records the distinct source IPs our server saw them from. Resolvers
+// behind a pool of backends show several. At least one query must be
+// answered.
+func EgressCheck(domain string, secret []byte, count int) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		network, resolver := resolverFor(t, "udp")
+
+		var ips []string
+		var lastErr error
+		for i := 0; i < count; i++ {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			src, err := queryEcho(ctx, network, resolver, egressName(domain, secret, t), secret, timeout)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if !slices.Contains(ips, src) {
+				ips = append(ips, src)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, lastErr
+		}
+		slices.Sort(ips)
+		return Metrics{"egress_ips": ips, "egress_count": float64(len(ips))}, nil
+	}
+}
+
+// CorrelateEgress adds the source IPs of tagged queries in a serve query log
+// to the egress IPs of the passed records they were sent through. A resolver
+// may forward one query from several backends, or retry from another one, and
+// only the log sees those. Log entries before since are skipped so that
+// earlier runs against the same resolvers do not count. Records without
+// egress IPs were not probed and are left alone.
+func CorrelateEgress(passed []IPRecord, secret []byte, logPath string, since time.Time) error {
+	byTag := make(map[string]*IPRecord, len(passed))
+	for i := range passed {
+		if passed[i].EgressIPs != nil {
+			byTag[EgressTag(secret, passed[i].Target)] = &passed[i]
+		}
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var q QueryLog
+		if json.Unmarshal(sc.Bytes(), &q) != nil || q.Time.Before(since) {
+			continue
+		}
+		tag, ok := parseEgressTag(q.Name)
+		if !ok {
+			continue
+		}
+		rec, ok := byTag[tag]
+		if !ok {
+			continue
+		}
+		if !slices.Contains(rec.EgressIPs, q.Src) {
+			rec.EgressIPs = append(rec.EgressIPs, q.Src)
+			slices.Sort(rec.EgressIPs)
+			rec.Metrics["egress_count"] = float64(len(rec.EgressIPs))
+		}
+	}
+	return sc.Err()
+}
+
+// egressIPs returns the egress_ips metric set by EgressCheck, which is a
+// []any after a JSON round trip through a checkpoint.
+func egressIPs(m Metrics) []string {
+	switch v := m["egress_ips"].(type) {
+	case []string:
+		return v
+	case []any:
+		ips := make([]string, 0, len(v))
+		for _, ip := range v {
+			if s, ok := ip.(string); ok {
+				ips = append(ips, s)
+			}
+		}
+		return ips
+	}
+	return nil
+}
+
+// EgressGroup is a set of resolvers that reached our server from at least
+// one common egress IP, directly or through other members of the group.
+type EgressGroup struct {
+	ID        int      `json:"id"`
+	Resolvers []string `json:"resolvers"`
+	EgressIPs []string `json:"egress_ips"`
+}
+
+// GroupEgress groups passed records that share egress IPs and sets
+// egress_group on the members of each group of two or more. Groups are
+// numbered from 1, largest first.
+func GroupEgress(passed []IPRecord) []EgressGroup {
+	parent := make([]int, len(passed))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	owner := make(map[string]int)
+	for i, rec := range passed {
+		for _, ip := range rec.EgressIPs {
+			if j, ok := owner[ip]; ok {
+				parent[find(i)] = find(j)
+			} else {
+				owner[ip] = i
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	for i := range passed {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	var sets [][]int
+	for _, m := range members {
+		if len(m) > 1 {
+			sets = append(sets, m)
+		}
+	}
+	slices.SortFunc(sets, func(a, b []int) int {
+		if d := len(b) - len(a); d != 0 {
+			return d
+		}
+		return a[0] - b[0]
+	})
+
+	groups := make([]EgressGroup, 0, len(sets))
+	for n, m := range sets {
+		g := EgressGroup{ID: n + 1}
+		for _, i := range m {
+			g.Resolvers = append(g.Resolvers, passed[i].String())
+			for _, ip := range passed[i].EgressIPs {
+				if !slices.Contains(g.EgressIPs, ip) {
+					g.EgressIPs = append(g.EgressIPs, ip)
+				}
+			}
+			passed[i].Metrics["egress_group"] = float64(g.ID)
+		}
+		slices.Sort(g.EgressIPs)
+		groups = append(groups, g)
+	}
+	return groups
+}
@@ -0,0 +1,162 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// InsecureTLS makes DoH and DoT queries accept any certificate, so resolvers
+// with self-signed or mismatched ones can still be measured. probeTLS reports
+// cert_valid either way.
+var InsecureTLS bool
+
+// dohClient is shared by all workers, so attempts against the same DoH
+// server reuse its connection like a real DoH client would. It is built on
+// first use, after InsecureTLS has been set.
+var dohClient = sync.OnceValue(func() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: InsecureTLS},
+			ForceAttemptHTTP2: true,
+		},
+	}
+})
+
+// tlsProbes caches probeTLS per target, so resolvers tested by several
+// steps of a chain are only probed once.
+var tlsProbes sync.Map // Target.String() -> *tlsProbe
+
+type tlsProbe struct {
+	done chan struct{}
+	m    Metrics
+	err  error
+}
+
+// exchangeDoH sends m as an RFC 8484 POST request to url.
+func exchangeDoH(ctx context.Context, url string, m *dns.Msg) (*dns.Msg, error) {
+	m.Id = 0
+	wire, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dohClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Failure{Stage: "query", Class: ClassHTTPStatus, Err: "HTTP " + strconv.Itoa(resp.StatusCode)}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// dotConfig returns the TLS config for a DoT resolver given as host:port.
+func dotConfig(resolver string) *tls.Config {
+	host, _, _ := net.SplitHostPort(resolver)
+	return &tls.Config{ServerName: host, InsecureSkipVerify: InsecureTLS}
+}
+
+// cachedProbeTLS returns the result of probing t with probeTLS, probing it
+// only the first time. Probes cut short by ctx are not kept.
+func cachedProbeTLS(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+	p := &tlsProbe{done: make(chan struct{})}
+	if v, loaded := tlsProbes.LoadOrStore(t.String(), p); loaded {
+		p = v.(*tlsProbe)
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if p.m == nil && p.err == nil {
+			// The first probe was interrupted
+			return probeTLS(ctx, t, timeout)
+		}
+	} else {
+		m, err := probeTLS(ctx, t, timeout)
+		if ctx.Err() != nil {
+			tlsProbes.Delete(t.String())
+		} else {
+			p.m, p.err = m, err
+		}
+		close(p.done)
+		if ctx.Err() != nil {
+			return m, err
+		}
+	}
+	return maps.Clone(p.m), p.err
+}
+
+// probeTLS opens one TLS connection to an encrypted resolver and reports the
+// handshake time, whether its certificate verifies for the resolver's name
+// and, for DoH, whether it negotiates HTTP/2.
+func probeTLS(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", t.Addr())
+	if err != nil {
+		return nil, newFailure("tls", err)
+	}
+	defer raw.Close()
+
+	cfg := &tls.Config{ServerName: t.IP, InsecureSkipVerify: true}
+	doh := t.Network() == "doh"
+	if doh {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	conn := tls.Client(raw, cfg)
+	start := time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, newFailure("tls", err)
+	}
+	ms := msSince(start)
+
+	state := conn.ConnectionState()
+	m := Metrics{
+		"tls_handshake_ms": ms,
+		"cert_valid":       verifyCert(state.PeerCertificates, t.IP),
+	}
+	if doh {
+		m["http2"] = state.NegotiatedProtocol == "h2"
+	}
+	return m, nil
+}
+
+func verifyCert(certs []*x509.Certificate, host string) bool {
+	if len(certs) == 0 {
+		return false
+	}
+	opts := x509.VerifyOptions{DNSName: host, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
@@ -0,0 +1,95 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Failure classes, from the most to the least resolver-specific.
+const (
+	ClassTimeout       = "timeout"        // no answer before the deadline
+	ClassNetwork       = "network"        // socket or routing error
+	ClassRcode         = "rcode"          // resolver answered with an error rcode
+	ClassBogusAnswer   = "bogus-answer"   // answer points at a private/sinkhole address
+	ClassEmptyAnswer   = "empty-answer"   // NOERROR without usable records
+	ClassInjected      = "injected"       // answers show signs of DNS injection
+	ClassUnverified    = "unverified"     // answer did not come from our serve instance
+	ClassNoDelegation  = "no-delegation"  // tunnel domain's NS records not found
+	ClassNoReply       = "no-reply"       // ping got no echo replies
+	ClassBadCert       = "bad-cert"       // DoH/DoT certificate does not verify
+	ClassHTTPStatus    = "http-status"    // test URL returned a non-200 status
+	ClassProcess       = "process"        // tunnel client exited or failed
+	ClassMissingBinary = "missing-binary" // required executable not in PATH
+	ClassLocal         = "local"          // a server the scanner queries itself was unreachable
+)
+
+// Failure describes why a check rejected an IP. It is returned as the error
+// of a CheckFunc and recorded on the failed IP in reports.
+type Failure struct {
+	Step     string `json:"step,omitempty"` // chain step that rejected the IP
+	Stage    string `json:"stage"`          // part of the check that failed
+	Class    string `json:"class"`
+	Rcode    string `json:"rcode,omitempty"`
+	Sinkhole string `json:"sinkhole,omitempty"` // label of the bogon range a bogus answer fell in
+	Err      string `json:"error,omitempty"`
+}
+
+func (f *Failure) Error() string {
+	msg := f.Stage + ": " + f.Class
+	if f.Rcode != "" {
+		msg += " " + f.Rcode
+	}
+	if f.Sinkhole != "" {
+		msg += " (" + f.Sinkhole + ")"
+	}
+	if f.Err != "" {
+		msg += ": " + f.Err
+	}
+	return msg
+}
+
+// newFailure classifies err as the cause of a failed stage. Errors that are
+// already a *Failure are returned unchanged.
+func newFailure(stage string, err error) *Failure {
+	var f *Failure
+	if errors.As(err, &f) {
+		return f
+	}
+	f = &Failure{Stage: stage, Class: ClassNetwork, Err: err.Error()}
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		f.Class = ClassTimeout
+	case errors.Is(err, exec.ErrNotFound):
+		f.Class = ClassMissingBinary
+	}
+	return f
+}
+
+// lastLine keeps the last non-empty line written to it, so a tunnel client's
+// final complaint can be reported when it fails.
+type lastLine struct {
+	mu   sync.Mutex
+	line string
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range strings.Split(string(p), "\n") {
+		if s = strings.TrimSpace(s); s != "" {
+			l.line = s
+		}
+	}
+	return len(p), nil
+}
+
+func (l *lastLine) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.line
+}
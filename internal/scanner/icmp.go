@@ -0,0 +1,181 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pinger sends ICMP echo requests over one socket shared by all workers and
+// hands each reply to the check waiting for it. There is one per address
+// family.
+type pinger struct {
+	conn *icmp.PacketConn
+	fam  *icmpFamily
+	raw  bool // raw sockets see every ICMP packet, so replies are filtered by ID
+	id   int
+
+	mu      sync.Mutex
+	seq     uint16
+	waiting map[pingKey]chan time.Time
+}
+
+type pingKey struct {
+	ip  string
+	seq uint16
+}
+
+type icmpFamily struct {
+	network, rawNetwork, addr string
+	proto                     int
+	request, reply            icmp.Type
+}
+
+var icmpFamilies = [2]icmpFamily{
+	{"udp4", "ip4:icmp", "0.0.0.0", 1, ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply},
+	{"udp6", "ip6:ipv6-icmp", "::", 58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply},
+}
+
+var sharedICMP [2]struct {
+	once   sync.Once
+	pinger *pinger
+	err    error
+}
+
+func sharedPinger(v6 bool) (*pinger, error) {
+	i := 0
+	if v6 {
+		i = 1
+	}
+	sharedICMP[i].once.Do(func() {
+		sharedICMP[i].pinger, sharedICMP[i].err = newPinger(&icmpFamilies[i])
+	})
+	return sharedICMP[i].pinger, sharedICMP[i].err
+}
+
+// newPinger prefers an unprivileged datagram ICMP socket and falls back to a
+// raw socket, which needs root or CAP_NET_RAW.
+func newPinger(fam *icmpFamily) (*pinger, error) {
+	p := &pinger{
+		fam:     fam,
+		id:      os.Getpid() & 0xffff,
+		waiting: make(map[pingKey]chan time.Time),
+	}
+	conn, err := icmp.ListenPacket(fam.network, fam.addr)
+	if err != nil {
+		var rawErr error
+		conn, rawErr = icmp.ListenPacket(fam.rawNetwork, fam.addr)
+		if rawErr != nil {
+			return nil, fmt.Errorf("opening %s socket: %v (raw: %v); allow unprivileged ping via net.ipv4.ping_group_range or grant CAP_NET_RAW", fam.rawNetwork, err, rawErr)
+		}
+		p.raw = true
+	}
+	p.conn = conn
+	go p.receive()
+	return p, nil
+}
+
+// maxReadBackoff caps the pause after failed reads of the shared socket.
+const maxReadBackoff = time.Second
+
+func (p *pinger) receive() {
+	buf := make([]byte, 1500)
+	var backoff time.Duration
+	for {
+		n, peer, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Keep the socket for later pings, but don't spin on an error
+			// that persists
+			backoff = min(max(2*backoff, time.Millisecond), maxReadBackoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		now := time.Now()
+		msg, err := icmp.ParseMessage(p.fam.proto, buf[:n])
+		if err != nil || msg.Type != p.fam.reply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || (p.raw && echo.ID != p.id) {
+			continue
+		}
+		key := pingKey{ip: addrIP(peer).String(), seq: uint16(echo.Seq)}
+		p.mu.Lock()
+		ch := p.waiting[key]
+		p.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- now:
+			default:
+			}
+		}
+	}
+}
+
+// ping sends one echo request and waits for the matching reply.
+func (p *pinger) ping(ctx context.Context, ip net.IP, timeout time.Duration) (time.Duration, error) {
+	p.mu.Lock()
+	p.seq++
+	key := pingKey{ip: ip.String(), seq: p.seq}
+	ch := make(chan time.Time, 1)
+	p.waiting[key] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiting, key)
+		p.mu.Unlock()
+	}()
+
+	msg := icmp.Message{
+		Type: p.fam.request,
+		Body: &icmp.Echo{ID: p.id, Seq: int(key.seq), Data: []byte("dnst-scanner")},
+	}
+	wb, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if p.raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	start := time.Now()
+	if _, err := p.conn.WriteTo(wb, dst); err != nil {
+		return 0, err
+	}
+	select {
+	case t := <-ch:
+		return t.Sub(start), nil
+	case <-timer.C:
+		return 0, &Failure{Stage: "ping", Class: ClassTimeout}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
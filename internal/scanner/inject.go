@@ -0,0 +1,440 @@
+package scanner
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxTTLDrift is how far the IP TTL of an answer may differ from that of the
+// resolver's baseline reply before it counts as an anomaly. Routes change,
+// but an on-path injector is rarely the same number of hops away as the
+// resolver.
+const maxTTLDrift = 2
+
+// Expected is the set of answers a domain should resolve to, from a file of
+// known-good addresses and/or a control resolver.
+type Expected struct {
+	Addrs   *Input // may be nil
+	Control string // host:port of a trusted resolver, queried over TCP
+
+	controlDone  bool
+	controlAddrs []netip.Addr
+	controlRcode int
+}
+
+// Known reports whether there is anything to compare answers with.
+func (e *Expected) Known() bool {
+	return e != nil && (e.Addrs != nil || e.Control != "")
+}
+
+// QueryControl takes the control resolver's answer for domain, which
+// InjectCheck then compares every resolver's with. It must be called before
+// the scan, so that a control resolver that cannot be reached stops the run
+// rather than failing each resolver. TCP keeps the control answer out of
+// reach of UDP injectors. Without a Control it does nothing.
+func (e *Expected) QueryControl(ctx context.Context, domain string, qtype uint16, timeout time.Duration) error {
+	if e == nil || e.Control == "" {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), qtype)
+	m.RecursionDesired = true
+	r, err := exchange(ctx, "tcp", e.Control, m, timeout, nil)
+	if err != nil {
+		return fmt.Errorf("control resolver %s: %w", e.Control, err)
+	}
+	e.controlAddrs, e.controlRcode, e.controlDone = answerAddrs(r), r.Rcode, true
+	return nil
+}
+
+func (e *Expected) match(a netip.Addr, control []netip.Addr) bool {
+	return slices.Contains(control, a) || e.Addrs != nil && e.Addrs.Contains(a)
+}
+
+// raceReply is one DNS response read for a query, with the IP header fields
+// of the packet that carried it. ttl and ipID are -1 when unknown.
+type raceReply struct {
+	msg  *dns.Msg
+	wire []byte
+	at   time.Duration
+	ttl  int
+	ipID int
+}
+
+// raceQuery sends m to resolver over UDP and reads every matching reply on
+// the socket until window after the first one, or timeout. An on-path
+// injector answers first; the resolver's own answer usually follows.
+func raceQuery(ctx context.Context, resolver string, m *dns.Msg, timeout, window time.Duration) ([]raceReply, error) {
+	addr, err := net.ResolveUDPAddr("udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	v4 := addr.IP.To4() != nil
+	network := "udp6"
+	if v4 {
+		network = "udp4"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// read returns the IP TTL (hop limit for IPv6) with each datagram
+	var read func(b []byte) (int, int, net.Addr, error)
+	if v4 {
+		pc := ipv4.NewPacketConn(conn)
+		pc.SetControlMessage(ipv4.FlagTTL, true)
+		read = func(b []byte) (int, int, net.Addr, error) {
+			n, cm, src, err := pc.ReadFrom(b)
+			ttl := -1
+			if cm != nil {
+				ttl = cm.TTL
+			}
+			return n, ttl, src, err
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		pc.SetControlMessage(ipv6.FlagHopLimit, true)
+		read = func(b []byte) (int, int, net.Addr, error) {
+			n, cm, src, err := pc.ReadFrom(b)
+			ttl := -1
+			if cm != nil {
+				ttl = cm.HopLimit
+			}
+			return n, ttl, src, err
+		}
+	}
+
+	// IP IDs are only visible to a raw socket, which needs CAP_NET_RAW
+	var captured chan capturedPacket
+	if v4 {
+		if c, err := sharedCapture(); err == nil {
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			captured = c.watch(port)
+			defer c.unwatch(port)
+		}
+	}
+
+	wire, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(wire, addr); err != nil {
+		return nil, err
+	}
+	deadline := start.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	var replies []raceReply
+	buf := make([]byte, dns.MaxMsgSize)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(deadline)
+		n, ttl, src, err := read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		if u, ok := src.(*net.UDPAddr); !ok || !u.IP.Equal(addr.IP) || u.Port != addr.Port {
+			continue
+		}
+		r := new(dns.Msg)
+		if r.Unpack(buf[:n]) != nil || r.Id != m.Id || len(r.Question) != 1 ||
+			!strings.EqualFold(r.Question[0].Name, m.Question[0].Name) {
+			continue
+		}
+		at := time.Since(start)
+		replies = append(replies, raceReply{msg: r, wire: slices.Clone(buf[:n]), at: at, ttl: ttl, ipID: -1})
+		if len(replies) == 1 && start.Add(at+window).Before(deadline) {
+			deadline = start.Add(at + window)
+		}
+	}
+	if len(replies) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, &Failure{Stage: "inject", Class: ClassTimeout}
+	}
+	if captured != nil {
+		matchCaptured(replies, captured)
+	}
+	return replies, nil
+}
+
+// matchCaptured fills in the IP IDs of replies from the packets the raw
+// capture saw, waiting briefly for the capture to catch up.
+func matchCaptured(replies []raceReply, captured chan capturedPacket) {
+	pending := len(replies)
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case p := <-captured:
+			for i := range replies {
+				if replies[i].ipID < 0 && string(replies[i].wire) == string(p.payload) {
+					replies[i].ipID = p.id
+					pending--
+					break
+				}
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+type capturedPacket struct {
+	id      int
+	payload []byte
+}
+
+// ipCapture reads all incoming UDP packets on a raw socket shared by all
+// workers and hands those addressed to a watched local port to its watcher.
+type ipCapture struct {
+	conn *ipv4.RawConn
+
+	mu      sync.Mutex
+	waiting map[int]chan capturedPacket
+}
+
+var sharedIPCapture struct {
+	once    sync.Once
+	capture *ipCapture
+	err     error
+}
+
+func sharedCapture() (*ipCapture, error) {
+	sharedIPCapture.once.Do(func() {
+		c, err := net.ListenPacket("ip4:udp", "0.0.0.0")
+		if err != nil {
+			sharedIPCapture.err = err
+			return
+		}
+		raw, err := ipv4.NewRawConn(c)
+		if err != nil {
+			c.Close()
+			sharedIPCapture.err = err
+			return
+		}
+		sharedIPCapture.capture = &ipCapture{conn: raw, waiting: make(map[int]chan capturedPacket)}
+		go sharedIPCapture.capture.receive()
+	})
+	return sharedIPCapture.capture, sharedIPCapture.err
+}
+
+func (c *ipCapture) watch(port int) chan capturedPacket {
+	ch := make(chan capturedPacket, 8)
+	c.mu.Lock()
+	c.waiting[port] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *ipCapture) unwatch(port int) {
+	c.mu.Lock()
+	delete(c.waiting, port)
+	c.mu.Unlock()
+}
+
+func (c *ipCapture) receive() {
+	buf := make([]byte, 65536)
+	for {
+		h, p, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if len(p) < 8 {
+			continue
+		}
+		port := int(binary.BigEndian.Uint16(p[2:4]))
+		c.mu.Lock()
+		ch := c.waiting[port]
+		c.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- capturedPacket{id: h.ID, payload: slices.Clone(p[8:])}:
+			default:
+			}
+		}
+	}
+}
+
+func answerAddrs(r *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		if a, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, a.Unmap())
+		}
+	}
+	return addrs
+}
+
+// describeReply summarizes a reply as its rcode and answer addresses.
+func describeReply(r *dns.Msg) string {
+	s := dns.RcodeToString[r.Rcode]
+	for i, a := range answerAddrs(r) {
+		if i == 0 {
+			s += " "
+		} else {
+			s += ","
+		}
+		s += a.String()
+	}
+	return s
+}
+
+// InjectCheck looks for signs that answers for domain are injected on the
+// path to each resolver:
+//
+//   - more than one differing reply to the same query on the same socket
+//   - answers outside the expected set, or bogus addresses
+//   - an error rcode where the control resolver has an answer
+//   - replies whose IP TTL or IP ID do not look like the resolver's own, as
+//     seen in its reply to a baseline query for the root zone
+//
+// The resolver passes if it answers; injected and injected_evidence record
+// what was found. With failInjected, resolvers with evidence fail instead.
+func InjectCheck(domain string, qtype uint16, expect *Expected, window time.Duration, failInjected bool) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		var control []netip.Addr
+		controlRcode := -1
+		if expect != nil && expect.controlDone {
+			control, controlRcode = expect.controlAddrs, expect.controlRcode
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domain), qtype)
+		m.RecursionDesired = true
+
+		var replies []raceReply
+		var baseline *raceReply
+		if network, resolver := resolverFor(t, "udp"); network == "udp" {
+			var err error
+			if replies, err = raceQuery(ctx, resolver, m, timeout, window); err != nil {
+				return nil, newFailure("inject", err)
+			}
+			b := new(dns.Msg)
+			b.SetQuestion(".", dns.TypeNS)
+			if base, err := raceQuery(ctx, resolver, b, timeout, 0); err == nil {
+				baseline = &base[0]
+			}
+		} else {
+			// Encrypted transports cannot be injected into on the path, but
+			// the resolver itself may still lie
+			start := time.Now()
+			r, err := exchange(ctx, network, resolver, m, timeout, nil)
+			if err != nil {
+				return nil, newFailure("inject", err)
+			}
+			replies = []raceReply{{msg: r, at: time.Since(start), ttl: -1, ipID: -1}}
+		}
+
+		var evidence []string
+		add := func(e string) {
+			if !slices.Contains(evidence, e) {
+				evidence = append(evidence, e)
+			}
+		}
+		if len(replies) > 1 {
+			distinct := map[string]bool{}
+			for _, r := range replies {
+				distinct[describeReply(r.msg)] = true
+			}
+			if len(distinct) > 1 {
+				desc := make([]string, len(replies))
+				for i, r := range replies {
+					desc[i] = fmt.Sprintf("%s at %.1fms", describeReply(r.msg), float64(r.at.Microseconds())/1000)
+				}
+				add(fmt.Sprintf("%d responses: %s", len(replies), strings.Join(desc, "; ")))
+			}
+		}
+		for _, r := range replies {
+			addrs := answerAddrs(r.msg)
+			for _, a := range addrs {
+				if b, ok := matchBogon(net.IP(a.AsSlice())); ok {
+					add("bogus answer " + a.String() + " (" + b.Label + ")")
+				}
+			}
+			if expect.Known() && len(addrs) > 0 && !slices.ContainsFunc(addrs, func(a netip.Addr) bool {
+				return expect.match(a, control)
+			}) {
+				add("unexpected answer " + describeReply(r.msg))
+			}
+			if r.msg.Rcode != dns.RcodeSuccess && controlRcode == dns.RcodeSuccess && len(control) > 0 {
+				add(dns.RcodeToString[r.msg.Rcode] + " where control resolves")
+			}
+			if baseline == nil {
+				continue
+			}
+			if r.ttl >= 0 && baseline.ttl >= 0 && abs(r.ttl-baseline.ttl) > maxTTLDrift {
+				add(fmt.Sprintf("IP TTL %d, baseline %d", r.ttl, baseline.ttl))
+			}
+			if r.ipID >= 0 && baseline.ipID >= 0 && (r.ipID == 0) != (baseline.ipID == 0) {
+				add(fmt.Sprintf("IP ID %d, baseline %d", r.ipID, baseline.ipID))
+			}
+		}
+
+		if failInjected && len(evidence) > 0 {
+			return nil, &Failure{Stage: "inject", Class: ClassInjected, Err: strings.Join(evidence, "; ")}
+		}
+		met := Metrics{
+			"inject_ms": roundMs(float64(replies[0].at.Microseconds()) / 1000.0),
+			"responses": float64(len(replies)),
+			"injected":  len(evidence) > 0,
+		}
+		if len(evidence) > 0 {
+			met["injected_evidence"] = evidence
+		}
+		if replies[0].ttl >= 0 {
+			met["ip_ttl"] = float64(replies[0].ttl)
+		}
+		return met, nil
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// ControlAddr adds the default port to a control resolver address given
+// without one.
+func ControlAddr(s string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	return net.JoinHostPort(s, strconv.Itoa(DefaultPort))
+}
@@ -2,45 +2,488 @@ package scanner
 
 import (
 	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"iter"
+	"math/bits"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-func LoadInput(path string, includeFailed bool) ([]string, error) {
-	if strings.HasSuffix(strings.ToLower(path), ".json") {
-		return loadJSON(path, includeFailed)
+// maxRangeSize bounds a single CIDR or dash range; a whole IPv4 /0 fits.
+const maxRangeSize = 1 << 32
+
+// Input is the deduplicated set of targets to scan. Single IPs, CIDRs and
+// dash ranges are kept as non-overlapping intervals per port, in input order,
+// and only expanded while iterating, so a /8 costs a few bytes rather than
+// 16M targets. DoH and DoT resolvers follow the plain ones.
+type Input struct {
+	ranges    []addrRange
+	encrypted []Target
+	count     int
+}
+
+type addrRange struct {
+	from, to netip.Addr
+	port     int
+}
+
+func (in *Input) Len() int { return in.count }
+
+func (in *Input) All() iter.Seq[Target] {
+	return func(yield func(Target) bool) {
+		for _, r := range in.ranges {
+			for a := r.from; ; a = a.Next() {
+				if !yield(Target{IP: a.String(), Port: r.port}) {
+					return
+				}
+				if a == r.to {
+					break
+				}
+			}
+		}
+		for _, t := range in.encrypted {
+			if !yield(t) {
+				return
+			}
+		}
+	}
+}
+
+// Exclude removes every address in ex from the input, on any port, and the
+// DoH and DoT resolvers ex lists by URL.
+func (in *Input) Exclude(ex *Input) {
+	addrs := make([]addrRange, len(ex.ranges))
+	for i, e := range ex.ranges {
+		addrs[i] = addrRange{from: e.from, to: e.to}
+	}
+	excl := mergeRanges(addrs)
+
+	var out []addrRange
+	for _, r := range in.ranges {
+		j := sort.Search(len(excl), func(k int) bool { return !excl[k].to.Less(r.from) })
+		for k := j; k < len(excl) && !r.to.Less(excl[k].from); k++ {
+			e := excl[k]
+			if r.from.Less(e.from) {
+				out = append(out, addrRange{r.from, e.from.Prev(), r.port})
+			}
+			if !e.to.Less(r.to) {
+				r.from = netip.Addr{}
+				break
+			}
+			r.from = e.to.Next()
+		}
+		if r.from.IsValid() {
+			out = append(out, r)
+		}
+	}
+	in.ranges = out
+
+	// Encrypted resolvers given by hostname are only excluded by URL
+	urls := make(map[string]bool, len(ex.encrypted))
+	for _, t := range ex.encrypted {
+		urls[t.URL] = true
+	}
+	var enc []Target
+	for _, t := range in.encrypted {
+		a, err := netip.ParseAddr(t.IP)
+		if urls[t.URL] || err == nil && excluded(excl, a.Unmap()) {
+			continue
+		}
+		enc = append(enc, t)
+	}
+	in.encrypted = enc
+	in.count = countRanges(out) + len(enc)
+}
+
+// Contains reports whether a is in the input, on any port.
+func (in *Input) Contains(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, r := range in.ranges {
+		if !a.Less(r.from) && !r.to.Less(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func excluded(excl []addrRange, a netip.Addr) bool {
+	i := sort.Search(len(excl), func(i int) bool { return !excl[i].to.Less(a) })
+	return i < len(excl) && !a.Less(excl[i].from)
+}
+
+// newInput drops the addresses each range shares with an earlier range on
+// the same port, keeping the input order. Encrypted resolvers are
+// deduplicated by URL.
+func newInput(ranges []addrRange, encrypted []Target) *Input {
+	ranges = dedupRanges(ranges)
+	seen := make(map[string]bool, len(encrypted))
+	var enc []Target
+	for _, t := range encrypted {
+		if !seen[t.URL] {
+			seen[t.URL] = true
+			enc = append(enc, t)
+		}
+	}
+	return &Input{ranges: ranges, encrypted: enc, count: countRanges(ranges) + len(enc)}
+}
+
+// mergeRanges sorts ranges by port and address and merges overlapping or
+// adjacent ones on the same port.
+func mergeRanges(ranges []addrRange) []addrRange {
+	ranges = slices.Clone(ranges)
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].port != ranges[j].port {
+			return ranges[i].port < ranges[j].port
+		}
+		return ranges[i].from.Less(ranges[j].from)
+	})
+	var merged []addrRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].port == r.port {
+			last := &merged[n-1]
+			if !last.to.Less(r.from) || last.to.Next() == r.from {
+				if last.to.Less(r.to) {
+					last.to = r.to
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// ownedRange is a range, or the part of one, and the input position of the
+// range it came from.
+type ownedRange struct {
+	addrRange
+	idx int
+}
+
+// dedupRanges gives every address to the first range containing it and
+// returns the resulting pieces in input order.
+func dedupRanges(ranges []addrRange) []addrRange {
+	// Most inputs are lists of single addresses, whose duplicates a set
+	// finds faster; only spans need the sweep below.
+	seen := make(map[addrRange]struct{}, len(ranges))
+	uniq := make([]addrRange, 0, len(ranges))
+	spans := false
+	for _, r := range ranges {
+		if r.from == r.to {
+			if _, dup := seen[r]; dup {
+				continue
+			}
+			seen[r] = struct{}{}
+		} else {
+			spans = true
+		}
+		uniq = append(uniq, r)
+	}
+	if !spans {
+		return uniq
+	}
+	ranges = uniq
+
+	sorted := make([]ownedRange, len(ranges))
+	for i, r := range ranges {
+		sorted[i] = ownedRange{r, i}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.port != b.port {
+			return a.port < b.port
+		}
+		if a.from != b.from {
+			return a.from.Less(b.from)
+		}
+		return a.idx < b.idx
+	})
+
+	pieces := make([]ownedRange, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		// Ranges that overlap, directly or through others, cover [from, hi]
+		hi := sorted[i].to
+		j := i + 1
+		for j < len(sorted) && sorted[j].port == sorted[i].port && !hi.Less(sorted[j].from) {
+			if hi.Less(sorted[j].to) {
+				hi = sorted[j].to
+			}
+			j++
+		}
+		if j == i+1 {
+			pieces = append(pieces, sorted[i])
+		} else {
+			pieces = append(pieces, splitOverlap(sorted[i:j], hi)...)
+		}
+		i = j
+	}
+
+	// Pieces of one range come from one group, already in address order
+	sort.SliceStable(pieces, func(i, j int) bool { return pieces[i].idx < pieces[j].idx })
+	out := make([]addrRange, len(pieces))
+	for i, p := range pieces {
+		out[i] = p.addrRange
+	}
+	return out
+}
+
+// splitOverlap splits overlapping ranges, sorted by start and together
+// covering up to hi, into pieces owned by the earliest range covering them.
+func splitOverlap(group []ownedRange, hi netip.Addr) []ownedRange {
+	bounds := make([]netip.Addr, 0, 2*len(group))
+	for _, r := range group {
+		bounds = append(bounds, r.from)
+		if r.to.Less(hi) {
+			bounds = append(bounds, r.to.Next())
+		}
+	}
+	slices.SortFunc(bounds, netip.Addr.Compare)
+	bounds = slices.Compact(bounds)
+
+	// Ranges covering the current bound, earliest in the input on top;
+	// those that ended are only removed once they reach the top.
+	active := &rangeHeap{}
+	var out []ownedRange
+	k := 0
+	for i, b := range bounds {
+		for k < len(group) && !b.Less(group[k].from) {
+			heap.Push(active, group[k])
+			k++
+		}
+		for (*active)[0].to.Less(b) {
+			heap.Pop(active)
+		}
+		owner := (*active)[0]
+		end := hi
+		if i+1 < len(bounds) {
+			end = bounds[i+1].Prev()
+		}
+		if n := len(out); n > 0 && out[n-1].idx == owner.idx {
+			out[n-1].to = end
+			continue
+		}
+		out = append(out, ownedRange{addrRange{b, end, owner.port}, owner.idx})
+	}
+	return out
+}
+
+type rangeHeap []ownedRange
+
+func (h rangeHeap) Len() int           { return len(h) }
+func (h rangeHeap) Less(i, j int) bool { return h[i].idx < h[j].idx }
+func (h rangeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *rangeHeap) Push(x any)        { *h = append(*h, x.(ownedRange)) }
+func (h *rangeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func countRanges(ranges []addrRange) int {
+	var n int
+	for _, r := range ranges {
+		size, _ := rangeSize(r)
+		n += int(size)
+	}
+	return n
+}
+
+// rangeSize returns the number of addresses in r, or false if it exceeds
+// maxRangeSize.
+func rangeSize(r addrRange) (uint64, bool) {
+	f, t := r.from.As16(), r.to.As16()
+	lo, borrow := bits.Sub64(binary.BigEndian.Uint64(t[8:]), binary.BigEndian.Uint64(f[8:]), 0)
+	hi, _ := bits.Sub64(binary.BigEndian.Uint64(t[:8]), binary.BigEndian.Uint64(f[:8]), borrow)
+	if hi != 0 || lo >= maxRangeSize {
+		return 0, false
+	}
+	return lo + 1, true
+}
+
+// parseRange parses a single IP (optionally with :port), a CIDR or an
+// "a.b.c.d-e.f.g.h" range. Ranges are always scanned on DefaultPort.
+func parseRange(s string) (addrRange, error) {
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		a, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return addrRange{}, err
+		}
+		b, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return addrRange{}, err
+		}
+		a, b = a.Unmap(), b.Unmap()
+		if a.Is4() != b.Is4() || b.Less(a) {
+			return addrRange{}, fmt.Errorf("invalid range %q", s)
+		}
+		return checkRange(addrRange{a, b, DefaultPort}, s)
+	}
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return addrRange{}, err
+		}
+		p = p.Masked()
+		return checkRange(addrRange{p.Addr(), lastAddr(p), DefaultPort}, s)
+	}
+	port := DefaultPort
+	if host, portStr, err := net.SplitHostPort(s); err == nil {
+		port, err = strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return addrRange{}, fmt.Errorf("invalid port in %q", s)
+		}
+		s = host
+	}
+	return parseTarget(s, port)
+}
+
+func parseTarget(ip string, port int) (addrRange, error) {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return addrRange{}, err
+	}
+	if port == 0 {
+		port = DefaultPort
+	}
+	a = a.Unmap()
+	return addrRange{a, a, port}, nil
+}
+
+func checkRange(r addrRange, s string) (addrRange, error) {
+	if _, ok := rangeSize(r); !ok {
+		return addrRange{}, fmt.Errorf("range %q too large", s)
+	}
+	return r, nil
+}
+
+// parseEncrypted parses a DoH URL (https://host[:port]/path) or a DoT
+// address (tls://host[:port]). The host may be a name or an IP.
+func parseEncrypted(s string) (Target, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Target{}, err
+	}
+	if u.Hostname() == "" {
+		return Target{}, fmt.Errorf("missing host in %q", s)
+	}
+	t := Target{IP: u.Hostname()}
+	switch u.Scheme {
+	case "https":
+		t.Port = 443
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+	case "tls":
+		t.Port = 853
+		u.Path, u.RawQuery = "", ""
+	default:
+		return Target{}, fmt.Errorf("unsupported scheme in %q", s)
+	}
+	if a, err := netip.ParseAddr(t.IP); err == nil {
+		t.IP = a.Unmap().String()
+	}
+	if p := u.Port(); p != "" {
+		t.Port, err = strconv.Atoi(p)
+		if err != nil || t.Port < 1 || t.Port > 65535 {
+			return Target{}, fmt.Errorf("invalid port in %q", s)
+		}
+	}
+	t.URL = u.String()
+	return t, nil
+}
+
+func isEncrypted(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "tls://")
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
 	}
-	return loadText(path)
+	a, _ := netip.AddrFromSlice(b)
+	return a
 }
 
-func loadText(path string) ([]string, error) {
+func LoadInput(path string, includeFailed bool) (*Input, error) {
+	lower := strings.ToLower(path)
+	var targets []Target
+	var err error
+	switch {
+	case strings.HasSuffix(lower, ".json"):
+		targets, err = loadJSON(path, includeFailed)
+	case strings.HasSuffix(lower, ".ndjson"), strings.HasSuffix(lower, ".jsonl"):
+		targets, err = loadNDJSON(path, includeFailed)
+	default:
+		return loadText(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]addrRange, 0, len(targets))
+	var encrypted []Target
+	for _, t := range targets {
+		if t.URL != "" {
+			encrypted = append(encrypted, t)
+			continue
+		}
+		// Reports written before ports were recorded have none
+		if r, err := parseTarget(t.IP, t.Port); err == nil {
+			ranges = append(ranges, r)
+		}
+	}
+	return newInput(ranges, encrypted), nil
+}
+
+// loadText reads one entry per line: an IP (optionally with :port), a CIDR
+// such as 5.160.0.0/16, a range such as 5.160.0.0-5.160.3.255, a DoH URL or
+// a tls://host:port DoT resolver.
+func loadText(path string) (*Input, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	var ips []string
+	var ranges []addrRange
+	var encrypted []Target
 	var skipped int
+	var total uint64
 	sc := bufio.NewScanner(f)
 	for sc.Scan() {
 		line := strings.TrimSpace(sc.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		ip := line
-		// Strip optional :port suffix
-		if host, _, err := net.SplitHostPort(line); err == nil {
-			ip = host
+		if isEncrypted(line) {
+			t, err := parseEncrypted(line)
+			if err != nil {
+				skipped++
+				continue
+			}
+			total++
+			encrypted = append(encrypted, t)
+			continue
 		}
-		if net.ParseIP(ip) == nil {
+		r, err := parseRange(line)
+		if err != nil {
 			skipped++
 			continue
 		}
-		ips = append(ips, ip)
+		size, _ := rangeSize(r)
+		total += size
+		ranges = append(ranges, r)
 	}
 	if err := sc.Err(); err != nil {
 		return nil, err
@@ -48,10 +491,14 @@ func loadText(path string) ([]string, error) {
 	if skipped > 0 {
 		fmt.Fprintf(os.Stderr, "input: skipped %d invalid entries\n", skipped)
 	}
-	return ips, nil
+	in := newInput(ranges, encrypted)
+	if dup := total - uint64(in.count); dup > 0 {
+		fmt.Fprintf(os.Stderr, "input: removed %d duplicate addresses\n", dup)
+	}
+	return in, nil
 }
 
-func loadJSON(path string, includeFailed bool) ([]string, error) {
+func loadJSON(path string, includeFailed bool) ([]Target, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -60,14 +507,46 @@ func loadJSON(path string, includeFailed bool) ([]string, error) {
 	if err := json.Unmarshal(data, &report); err != nil {
 		return nil, err
 	}
-	ips := make([]string, 0, len(report.Passed)+len(report.Failed))
+	targets := make([]Target, 0, len(report.Passed)+len(report.Failed))
 	for _, rec := range report.Passed {
-		ips = append(ips, rec.IP)
+		targets = append(targets, rec.Target)
 	}
 	if includeFailed {
 		for _, rec := range report.Failed {
-			ips = append(ips, rec.IP)
+			targets = append(targets, rec.Target)
+		}
+	}
+	return targets, nil
+}
+
+func loadNDJSON(path string, includeFailed bool) ([]Target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []Target
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec NDJSONRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if rec.Type != "result" || rec.IPRecord == nil {
+			continue
 		}
+		if rec.Status == "passed" || includeFailed {
+			targets = append(targets, rec.Target)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
 	}
-	return ips, nil
+	return targets, nil
 }
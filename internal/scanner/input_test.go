@@ -0,0 +1,255 @@
+package scanner
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		from, to string
+		port     int
+		wantErr  bool
+	}{
+		{in: "1.2.3.4", from: "1.2.3.4", to: "1.2.3.4", port: 53},
+		{in: "1.2.3.4:5353", from: "1.2.3.4", to: "1.2.3.4", port: 5353},
+		{in: "::ffff:1.2.3.4", from: "1.2.3.4", to: "1.2.3.4", port: 53},
+		{in: "[2001:db8::1]:54", from: "2001:db8::1", to: "2001:db8::1", port: 54},
+		{in: "2001:db8::1", from: "2001:db8::1", to: "2001:db8::1", port: 53},
+		{in: "10.0.0.0/30", from: "10.0.0.0", to: "10.0.0.3", port: 53},
+		{in: "10.0.0.7/30", from: "10.0.0.4", to: "10.0.0.7", port: 53},
+		{in: "0.0.0.0/0", from: "0.0.0.0", to: "255.255.255.255", port: 53},
+		{in: "2001:db8::/126", from: "2001:db8::", to: "2001:db8::3", port: 53},
+		{in: "10.0.0.1-10.0.1.0", from: "10.0.0.1", to: "10.0.1.0", port: 53},
+		{in: "10.0.0.1 - 10.0.0.1", from: "10.0.0.1", to: "10.0.0.1", port: 53},
+		{in: "10.0.0.2-10.0.0.1", wantErr: true},
+		{in: "10.0.0.1-2001:db8::1", wantErr: true},
+		{in: "2001:db8::/64", wantErr: true},
+		{in: "1.2.3.4:0", wantErr: true},
+		{in: "1.2.3.4:65536", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "example.com", wantErr: true},
+		{in: "10.0.0.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		r, err := parseRange(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRange(%q) = %v, want error", tt.in, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%q): %v", tt.in, err)
+			continue
+		}
+		want := addrRange{netip.MustParseAddr(tt.from), netip.MustParseAddr(tt.to), tt.port}
+		if r != want {
+			t.Errorf("parseRange(%q) = %v, want %v", tt.in, r, want)
+		}
+	}
+}
+
+func TestParseEncrypted(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Target
+		wantErr bool
+	}{
+		{in: "https://dns.example.com", want: Target{IP: "dns.example.com", Port: 443, URL: "https://dns.example.com/dns-query"}},
+		{in: "https://1.1.1.1/resolve", want: Target{IP: "1.1.1.1", Port: 443, URL: "https://1.1.1.1/resolve"}},
+		{in: "https://[2001:db8::1]:8443/dns-query", want: Target{IP: "2001:db8::1", Port: 8443, URL: "https://[2001:db8::1]:8443/dns-query"}},
+		{in: "tls://dns.google", want: Target{IP: "dns.google", Port: 853, URL: "tls://dns.google"}},
+		{in: "tls://9.9.9.9:8853/ignored?x=1", want: Target{IP: "9.9.9.9", Port: 8853, URL: "tls://9.9.9.9:8853"}},
+		{in: "https://", wantErr: true},
+		{in: "tls://host:99999", wantErr: true},
+		{in: "quic://dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseEncrypted(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseEncrypted(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEncrypted(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseEncrypted(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// testInput builds an Input from text input lines.
+func testInput(t *testing.T, lines ...string) *Input {
+	t.Helper()
+	var ranges []addrRange
+	var enc []Target
+	for _, l := range lines {
+		if isEncrypted(l) {
+			e, err := parseEncrypted(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc = append(enc, e)
+			continue
+		}
+		r, err := parseRange(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = append(ranges, r)
+	}
+	return newInput(ranges, enc)
+}
+
+func targetStrings(in *Input) []string {
+	var out []string
+	for tg := range in.All() {
+		out = append(out, tg.String())
+	}
+	return out
+}
+
+func TestInputOrderAndDedup(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "order kept",
+			lines: []string{"9.9.9.9", "1.1.1.1", "8.8.8.8:5353"},
+			want:  []string{"9.9.9.9:53", "1.1.1.1:53", "8.8.8.8:5353"},
+		},
+		{
+			name:  "duplicates keep first position",
+			lines: []string{"2.2.2.2", "1.1.1.1", "2.2.2.2", "1.1.1.1"},
+			want:  []string{"2.2.2.2:53", "1.1.1.1:53"},
+		},
+		{
+			name:  "same ip on other port is distinct",
+			lines: []string{"1.1.1.1:53", "1.1.1.1:5353"},
+			want:  []string{"1.1.1.1:53", "1.1.1.1:5353"},
+		},
+		{
+			name:  "overlapping ranges",
+			lines: []string{"10.0.0.2-10.0.0.4", "10.0.0.0/29", "10.0.0.3"},
+			want: []string{
+				"10.0.0.2:53", "10.0.0.3:53", "10.0.0.4:53",
+				"10.0.0.0:53", "10.0.0.1:53", "10.0.0.5:53", "10.0.0.6:53", "10.0.0.7:53",
+			},
+		},
+		{
+			name:  "later range inside earlier",
+			lines: []string{"10.0.0.5", "10.0.0.0/30", "10.0.0.1-10.0.0.6"},
+			want: []string{
+				"10.0.0.5:53",
+				"10.0.0.0:53", "10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53",
+				"10.0.0.4:53", "10.0.0.6:53",
+			},
+		},
+		{
+			name:  "range ending at the top of the address space",
+			lines: []string{"255.255.255.254-255.255.255.255", "255.255.255.255", "255.255.255.253/32"},
+			want:  []string{"255.255.255.254:53", "255.255.255.255:53", "255.255.255.253:53"},
+		},
+		{
+			name:  "encrypted follow plain and are deduplicated",
+			lines: []string{"tls://dns.google", "1.1.1.1", "tls://dns.google", "https://dns.example.com"},
+			want:  []string{"1.1.1.1:53", "tls://dns.google", "https://dns.example.com/dns-query"},
+		},
+	}
+	for _, tt := range tests {
+		in := testInput(t, tt.lines...)
+		got := targetStrings(in)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if in.Len() != len(tt.want) {
+			t.Errorf("%s: Len() = %d, want %d", tt.name, in.Len(), len(tt.want))
+		}
+	}
+}
+
+func TestInputExclude(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:    "single address on any port",
+			lines:   []string{"1.1.1.1:53", "2.2.2.2", "1.1.1.1:5353"},
+			exclude: []string{"1.1.1.1"},
+			want:    []string{"2.2.2.2:53"},
+		},
+		{
+			name:    "hole in a range",
+			lines:   []string{"10.0.0.0/29"},
+			exclude: []string{"10.0.0.2-10.0.0.3", "10.0.0.6"},
+			want:    []string{"10.0.0.0:53", "10.0.0.1:53", "10.0.0.4:53", "10.0.0.5:53", "10.0.0.7:53"},
+		},
+		{
+			name:    "order kept",
+			lines:   []string{"10.0.0.9", "10.0.0.0/30", "10.0.0.8"},
+			exclude: []string{"10.0.0.1", "10.0.0.8"},
+			want:    []string{"10.0.0.9:53", "10.0.0.0:53", "10.0.0.2:53", "10.0.0.3:53"},
+		},
+		{
+			name:    "everything",
+			lines:   []string{"10.0.0.0/30", "10.0.0.2"},
+			exclude: []string{"10.0.0.0/24"},
+			want:    nil,
+		},
+		{
+			name:    "encrypted by address only",
+			lines:   []string{"tls://9.9.9.9", "tls://dns.google", "https://8.8.8.8/dns-query"},
+			exclude: []string{"9.9.9.9", "8.8.8.0/24"},
+			want:    []string{"tls://dns.google"},
+		},
+		{
+			name:    "encrypted by URL",
+			lines:   []string{"tls://dns.google", "https://dns.example.com", "https://dns.example.com/other", "tls://9.9.9.9"},
+			exclude: []string{"tls://dns.google", "https://dns.example.com/dns-query"},
+			want:    []string{"https://dns.example.com/other", "tls://9.9.9.9"},
+		},
+	}
+	for _, tt := range tests {
+		in := testInput(t, tt.lines...)
+		in.Exclude(testInput(t, tt.exclude...))
+		got := targetStrings(in)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if in.Len() != len(tt.want) {
+			t.Errorf("%s: Len() = %d, want %d", tt.name, in.Len(), len(tt.want))
+		}
+	}
+}
+
+func TestInputContains(t *testing.T) {
+	in := testInput(t, "10.0.0.8", "10.0.0.0/30", "2001:db8::1")
+	for _, tt := range []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.0.0.3", true},
+		{"10.0.0.4", false},
+		{"10.0.0.8", true},
+		{"::ffff:10.0.0.8", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	} {
+		if got := in.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
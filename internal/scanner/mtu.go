@@ -0,0 +1,192 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Bounds of the response size search. The upper bound is the largest EDNS0
+// UDP payload a resolver is asked for.
+const (
+	minResponseSize = 128
+	maxResponseSize = 4096
+)
+
+// tcProbeSize is the response size asked for without EDNS0 to see whether
+// the resolver truncates it and serves it over TCP. It is above the 512
+// bytes a plain DNS reply over UDP is limited to.
+const tcProbeSize = 1024
+
+// sizedName returns a name under domain that is exactly total characters
+// long (without the trailing dot), using random labels of up to 63
+// characters.
+func sizedName(domain string, total int) string {
+	domain = strings.TrimSuffix(domain, ".")
+	var labels []string
+	for rem := total - len(domain); rem >= 2; {
+		n := min(63, rem-1)
+		if rem-1-n == 1 {
+			n-- // a lone dot cannot follow
+		}
+		labels = append(labels, randomLabel(n))
+		rem -= n + 1
+	}
+	return strings.Join(append(labels, domain), ".")
+}
+
+// ResponseName is the query name asking the authoritative server for a TXT
+// response of exactly size bytes: r<size>-<nonce>.<domain>.
+func ResponseName(domain string, size int) string {
+	return fmt.Sprintf("r%d-%s.%s", size, randomLabel(8), strings.TrimSuffix(domain, "."))
+}
+
+// ParseResponseName returns the size requested by the first label of a
+// ResponseName, or false if label is not one.
+func ParseResponseName(label string) (int, bool) {
+	rest, ok := strings.CutPrefix(strings.ToLower(label), "r")
+	if !ok {
+		return 0, false
+	}
+	num, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.Atoi(num)
+	return size, err == nil && size > 0
+}
+
+// searchMax returns the largest n in [lo, hi] for which ok(n) holds, assuming
+// ok is monotone and ok(lo) holds.
+func searchMax(ctx context.Context, lo, hi int, ok func(n int) bool) int {
+	for lo < hi && ctx.Err() == nil {
+		mid := lo + (hi-lo+1)/2
+		if ok(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// MTUCheck finds the largest query name and response a resolver carries to
+// and from the tunnel domain's server, by binary search. A query name probe
+// succeeds if it gets any reply other than SERVFAIL. Response sizes need a
+// server that answers ResponseName queries (see the serve command); each
+// probe asks for a TXT response of a given size with an EDNS0 buffer of
+// maxResponseSize, and succeeds if it arrives whole over UDP. The target
+// fails if not even the smallest sized response comes back.
+func MTUCheck(domain string) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		network, resolver := resolverFor(t, "udp")
+
+		// Each probe gets a second chance so a lost packet does not end the
+		// search early
+		retry := func(probe func() error) error {
+			err := probe()
+			if err != nil && ctx.Err() == nil {
+				err = probe()
+			}
+			return err
+		}
+
+		minName := len(strings.TrimSuffix(domain, ".")) + 2
+		if err := retry(func() error {
+			return QueryTunnel(ctx, network, resolver, sizedName(domain, minName), dns.TypeTXT, timeout)
+		}); err != nil {
+			f := newFailure("mtu", err)
+			f.Stage = "mtu"
+			return nil, f
+		}
+		maxName := searchMax(ctx, minName, maxNameLen, func(n int) bool {
+			return retry(func() error {
+				return QueryTunnel(ctx, network, resolver, sizedName(domain, n), dns.TypeTXT, timeout)
+			}) == nil
+		})
+		m := Metrics{"max_qname_len": float64(maxName)}
+
+		var r *dns.Msg
+		err := retry(func() (err error) {
+			r, err = sizedResponse(ctx, network, resolver, domain, minResponseSize, maxResponseSize, timeout)
+			if err == nil && r.Truncated {
+				err = errTruncated
+			}
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			f := newFailure("mtu", err)
+			f.Stage = "mtu"
+			f.Err = fmt.Sprintf("no %d-byte response (is %s served by the serve command?): %s", minResponseSize, domain, f.Err)
+			return nil, f
+		}
+		m["edns_supported"] = r.IsEdns0() != nil
+
+		maxResp := searchMax(ctx, minResponseSize, maxResponseSize, func(n int) bool {
+			return retry(func() error {
+				r, err := sizedResponse(ctx, network, resolver, domain, n, maxResponseSize, timeout)
+				if err == nil && r.Truncated {
+					return errTruncated
+				}
+				return err
+			}) == nil
+		})
+		m["max_response_bytes"] = float64(maxResp)
+
+		// Whether a response too large for UDP can be fetched over TCP after
+		// the resolver sets TC. Asking without EDNS0 makes any response over
+		// 512 bytes too large, whatever the path carries. DoH and DoT
+		// resolvers are not asked over UDP and never truncate.
+		if t.Network() == "" {
+			fallback := false
+			r, err = sizedResponse(ctx, "udp", resolver, domain, tcProbeSize, 0, timeout)
+			if err == nil && r.Truncated {
+				_, err = sizedResponse(ctx, "tcp", resolver, domain, tcProbeSize, maxResponseSize, timeout)
+				fallback = err == nil
+			}
+			m["tc_fallback"] = fallback
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return m, nil
+	}
+}
+
+var errTruncated = errors.New("truncated")
+
+// sizedResponse asks for a TXT response of size bytes, advertising an EDNS0
+// buffer of bufSize (none if 0), and checks that it carries an answer of
+// about that size. Resolvers may re-encode the message, so a little slack is
+// allowed. Truncated replies are returned as they are.
+func sizedResponse(ctx context.Context, network, resolver, domain string, size int, bufSize uint16, timeout time.Duration) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(ResponseName(domain, size)), dns.TypeTXT)
+	m.RecursionDesired = true
+	if bufSize > 0 {
+		m.SetEdns0(bufSize, false)
+	}
+
+	r, err := exchange(ctx, network, resolver, m, timeout, nil)
+	if err != nil {
+		return nil, newFailure("mtu", err)
+	}
+	if r.Truncated {
+		return r, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, rcodeFailure("mtu", r.Rcode)
+	}
+	if len(r.Answer) == 0 || r.Len() < size-64 {
+		return nil, &Failure{Stage: "mtu", Class: ClassEmptyAnswer, Err: fmt.Sprintf("response of %d bytes, asked for %d", r.Len(), size)}
+	}
+	return r, nil
+}
@@ -1,34 +1,59 @@
 package scanner
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type IPRecord struct {
-	IP      string  `json:"ip"`
-	Metrics Metrics `json:"metrics,omitempty"`
+	Target
+	Metrics   Metrics  `json:"metrics,omitempty"`
+	EgressIPs []string `json:"egress_ips,omitempty"`
+	Failure   *Failure `json:"failure,omitempty"`
+}
+
+// passedRecord returns the record of a target that passed with metrics m.
+// The egress IPs found by EgressCheck travel among the metrics, as a check
+// can only return those, and are moved to their own field here.
+func passedRecord(t Target, m Metrics) IPRecord {
+	ips := egressIPs(m)
+	if ips == nil {
+		return IPRecord{Target: t, Metrics: m}
+	}
+	m = maps.Clone(m)
+	delete(m, "egress_ips")
+	return IPRecord{Target: t, Metrics: m, EgressIPs: ips}
 }
 
 type Report struct {
-	Passed []IPRecord `json:"passed"`
-	Failed []IPRecord `json:"failed"`
+	Passed       []IPRecord    `json:"passed"`
+	Failed       []IPRecord    `json:"failed"`
+	EgressGroups []EgressGroup `json:"egress_groups,omitempty"`
 }
 
-func WriteReport(results []Result, path string) error {
+func NewReport(results []Result) Report {
 	report := Report{
 		Passed: []IPRecord{},
 		Failed: []IPRecord{},
 	}
 	for _, r := range results {
 		if r.OK {
-			report.Passed = append(report.Passed, IPRecord{IP: r.IP, Metrics: r.Metrics})
+			report.Passed = append(report.Passed, passedRecord(r.Target, r.Metrics))
 		} else {
-			report.Failed = append(report.Failed, IPRecord{IP: r.IP})
+			report.Failed = append(report.Failed, IPRecord{Target: r.Target, Failure: r.Failure})
 		}
 	}
+	return report
+}
+
+func WriteReport(report Report, path string) error {
 	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
 		return err
@@ -36,15 +61,159 @@ func WriteReport(results []Result, path string) error {
 	return os.WriteFile(path, data, 0644)
 }
 
-func PrintStats(mode string, results []Result, duration time.Duration) {
-	var passCount, failCount int
-	for _, r := range results {
-		if r.OK {
-			passCount++
-		} else {
-			failCount++
+// WriteTable writes a CSV (comma ',') or TSV (comma '\t') file with one row
+// per IP, passed records first. Metrics and egress IPs are flattened into
+// one column per key found in any record, sorted by name; cells are empty
+// where a record lacks the key.
+func WriteTable(passed, failed []IPRecord, path string, comma rune) error {
+	keySet := make(map[string]struct{})
+	for _, rec := range passed {
+		for k := range rec.Metrics {
+			keySet[k] = struct{}{}
+		}
+		if rec.EgressIPs != nil {
+			keySet["egress_ips"] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for k := range keySet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Comma = comma
+
+	header := append([]string{"ip", "port", "url", "status", "failed_step", "failure_class"}, keys...)
+	w.Write(header)
+	row := make([]string, len(header))
+	for _, rec := range passed {
+		row[0], row[1], row[2], row[3], row[4], row[5] = rec.IP, strconv.Itoa(rec.Port), rec.URL, "passed", "", ""
+		for i, k := range keys {
+			row[6+i] = ""
+			if v, ok := rec.Metrics[k]; ok {
+				row[6+i] = formatCell(v)
+			} else if k == "egress_ips" && rec.EgressIPs != nil {
+				row[6+i] = formatCell(rec.EgressIPs)
+			}
+		}
+		w.Write(row)
+	}
+	for _, rec := range failed {
+		clear(row)
+		row[0], row[1], row[2], row[3] = rec.IP, strconv.Itoa(rec.Port), rec.URL, "failed"
+		if rec.Failure != nil {
+			row[4], row[5] = rec.Failure.Step, rec.Failure.Class
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func formatCell(v any) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = formatCell(e)
 		}
+		return strings.Join(parts, " ")
+	case []string:
+		return strings.Join(v, " ")
 	}
+	return fmt.Sprint(v)
+}
+
+func PrintStats(mode string, passed, failed int, duration time.Duration) {
 	fmt.Fprintf(os.Stdout, "%s: %d tested | %d pass | %d fail | %.1fs\n",
-		mode, len(results), passCount, failCount, duration.Seconds())
+		mode, passed+failed, passed, failed, duration.Seconds())
+}
+
+// NDJSONRecord is one line of NDJSON output: either the final result for a
+// single IP or, as the last line, a summary of the whole run.
+type NDJSONRecord struct {
+	Type   string `json:"type"` // "result" or "summary"
+	Status string `json:"status,omitempty"`
+	*IPRecord
+	*Summary
+}
+
+type Summary struct {
+	Tested       int           `json:"tested"`
+	Passed       int           `json:"passed"`
+	Failed       int           `json:"failed"`
+	Seconds      float64       `json:"duration_secs"`
+	Steps        []StepResult  `json:"steps,omitempty"`
+	EgressGroups []EgressGroup `json:"egress_groups,omitempty"`
+	Interrupted  bool          `json:"interrupted,omitempty"`
+}
+
+// NDJSONWriter appends one JSON line per record as soon as it is written, so
+// results are visible (and survive a crash) while the scan is still running.
+type NDJSONWriter struct {
+	f      *os.File
+	enc    *json.Encoder
+	passed int
+	failed int
+	err    error
+}
+
+func NewNDJSONWriter(path string) (*NDJSONWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// WriteRecord writes the final result for one IP. Write errors are sticky
+// and reported by Close.
+func (w *NDJSONWriter) WriteRecord(rec IPRecord, passed bool) {
+	line := NDJSONRecord{Type: "result", Status: "failed", IPRecord: &rec}
+	if passed {
+		line.Status = "passed"
+		w.passed++
+	} else {
+		w.failed++
+	}
+	if w.err == nil {
+		w.err = w.enc.Encode(line)
+	}
+}
+
+func (w *NDJSONWriter) WriteResult(r Result) {
+	if r.OK {
+		w.WriteRecord(passedRecord(r.Target, r.Metrics), true)
+	} else {
+		w.WriteRecord(IPRecord{Target: r.Target, Failure: r.Failure}, false)
+	}
+}
+
+func (w *NDJSONWriter) Counts() (passed, failed int) {
+	return w.passed, w.failed
+}
+
+// Close writes the summary line, filling in the counts of records written,
+// and closes the file.
+func (w *NDJSONWriter) Close(summary Summary) error {
+	summary.Passed, summary.Failed = w.passed, w.failed
+	summary.Tested = w.passed + w.failed
+	if w.err == nil {
+		w.err = w.enc.Encode(NDJSONRecord{Type: "summary", Summary: &summary})
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
 }
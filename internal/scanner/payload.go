@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNameLen is the longest domain name in presentation form, without the
+// trailing dot.
+const maxNameLen = 253
+
+var payloadEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// payloadName returns a dnstt-style query name: random lowercase base32
+// labels of labelLen characters prepended to domain until the name is as long
+// as it can be.
+func payloadName(domain string, labelLen int) string {
+	domain = strings.TrimSuffix(domain, ".")
+	n := (maxNameLen - len(domain)) / (labelLen + 1)
+	if n < 1 {
+		n = 1
+	}
+	labels := make([]string, 0, n+1)
+	for i := 0; i < n; i++ {
+		labels = append(labels, randomLabel(labelLen))
+	}
+	return strings.Join(append(labels, domain), ".")
+}
+
+// randomLabel returns n random lowercase base32 characters.
+func randomLabel(n int) string {
+	buf := make([]byte, (n*5+7)/8)
+	rand.Read(buf)
+	return strings.ToLower(payloadEncoding.EncodeToString(buf))[:n]
+}
+
+// PayloadCheck sends count queries shaped like dnstt's: random base32 labels
+// of labelLen characters under the tunnel domain, with the given qtype. Each
+// reply other than SERVFAIL means the query reached the tunnel server. All
+// count queries are sent and the target passes if at least minRatio of them
+// were answered. With rate 0 the queries go one after another; otherwise a
+// new query is started every 1/rate seconds without waiting for the earlier
+// ones, the way a tunnel client keeps several queries in flight.
+func PayloadCheck(domain string, labelLen int, qtype uint16, transport string, count int, minRatio, rate float64) CheckFunc {
+	return func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error) {
+		network, resolver := resolverFor(t, transport)
+
+		var (
+			mu      sync.Mutex
+			rtts    []float64
+			lastErr error
+		)
+		send := func() {
+			start := time.Now()
+			err := QueryTunnel(ctx, network, resolver, payloadName(domain, labelLen), qtype, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			rtts = append(rtts, msSince(start))
+		}
+
+		if rate > 0 {
+			var wg sync.WaitGroup
+			tick := time.NewTicker(time.Duration(float64(time.Second) / rate))
+			for i := 0; i < count; i++ {
+				if i > 0 {
+					select {
+					case <-tick.C:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					send()
+				}()
+			}
+			tick.Stop()
+			wg.Wait()
+		} else {
+			for i := 0; i < count && ctx.Err() == nil; i++ {
+				send()
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		ratio := float64(len(rtts)) / float64(count)
+		if len(rtts) == 0 || ratio < minRatio {
+			f := newFailure("payload", lastErr)
+			f.Stage = "payload"
+			summary := fmt.Sprintf("%d of %d answered", len(rtts), count)
+			if f.Err != "" {
+				summary += ", last: " + f.Err
+			}
+			f.Err = summary
+			return nil, f
+		}
+
+		var sum float64
+		for _, v := range rtts {
+			sum += v
+		}
+		return Metrics{
+			"payload_ms":       roundMs(sum / float64(len(rtts))),
+			"payload_ok_ratio": roundMs(ratio),
+			"transport":        network,
+		}, nil
+	}
+}
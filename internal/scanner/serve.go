@@ -0,0 +1,228 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server is an authoritative DNS server for a test zone. It answers the
+// probe names the checks send so they can tell its answers from a
+// middlebox's:
+//
+//	e-<nonce>.<zone> TXT        signed echo of the query name and source IP
+//	r<size>-<nonce>.<zone> TXT  response padded to exactly size bytes
+//
+// Every other name under the zone is NXDOMAIN.
+type Server struct {
+	Zone   string   // fully qualified, lowercase
+	NS     []string // NS host names for the zone apex
+	Secret []byte   // signs echo answers if set
+
+	logMu  sync.Mutex
+	logBuf *bufio.Writer
+	enc    *json.Encoder
+}
+
+// logFlushInterval is how often the buffered query log is written out.
+const logFlushInterval = time.Second
+
+// QueryLog is one line of the server's NDJSON query log.
+type QueryLog struct {
+	Time  time.Time `json:"time"`
+	Src   string    `json:"src"`
+	Proto string    `json:"proto"`
+	Name  string    `json:"name"`
+	Type  string    `json:"type"`
+}
+
+func NewServer(zone string, ns []string, secret []byte, log io.Writer) *Server {
+	s := &Server{Zone: dns.Fqdn(strings.ToLower(zone)), Secret: secret}
+	for _, h := range ns {
+		s.NS = append(s.NS, dns.Fqdn(h))
+	}
+	if log != nil {
+		s.logBuf = bufio.NewWriterSize(log, 64<<10)
+		s.enc = json.NewEncoder(s.logBuf)
+	}
+	return s
+}
+
+// ListenAndServe serves the zone over UDP and TCP on addr until ctx is
+// cancelled. The query log is flushed every logFlushInterval and on return.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	if s.logBuf != nil {
+		done := make(chan struct{})
+		defer func() {
+			close(done)
+			s.flushLog()
+		}()
+		go func() {
+			tick := time.NewTicker(logFlushInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-tick.C:
+					s.flushLog()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: s},
+		{Addr: addr, Net: "tcp", Handler: s},
+	}
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { errs <- srv.ListenAndServe() }()
+	}
+	select {
+	case err := <-errs:
+		for _, srv := range servers {
+			srv.Shutdown()
+		}
+		return err
+	case <-ctx.Done():
+		for _, srv := range servers {
+			srv.Shutdown()
+		}
+		return nil
+	}
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	src := addrIP(w.RemoteAddr())
+	s.log(src, w.RemoteAddr().Network(), name, q.Qtype)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if !dns.IsSubDomain(s.Zone, name) {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	bufSize := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+		bufSize = max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+
+	label := strings.SplitN(name, ".", 2)[0]
+	size, sized := ParseResponseName(label)
+	switch {
+	case name == s.Zone:
+		switch q.Qtype {
+		case dns.TypeSOA:
+			m.Answer = append(m.Answer, s.soa())
+		case dns.TypeNS:
+			for _, h := range s.NS {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: s.hdr(name, dns.TypeNS), Ns: h})
+			}
+		default:
+			m.Ns = append(m.Ns, s.soa())
+		}
+
+	case strings.HasPrefix(label, "e-") && q.Qtype == dns.TypeTXT:
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: s.hdr(q.Name, dns.TypeTXT), Txt: s.echo(name, src.String())})
+
+	case sized && q.Qtype == dns.TypeTXT:
+		if size > dns.MaxMsgSize {
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+		txt := &dns.TXT{Hdr: s.hdr(q.Name, dns.TypeTXT)}
+		m.Answer = append(m.Answer, txt)
+		padTXT(m, txt, size)
+		if w.RemoteAddr().Network() == "udp" && m.Len() > bufSize {
+			m.Answer = nil
+			m.Truncated = true
+		}
+
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, s.soa())
+	}
+	w.WriteMsg(m)
+}
+
+func (s *Server) log(src net.IP, proto, name string, qtype uint16) {
+	if s.enc == nil {
+		return
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.enc.Encode(QueryLog{Time: time.Now().UTC(), Src: src.String(), Proto: proto, Name: name, Type: dns.TypeToString[qtype]})
+}
+
+func (s *Server) flushLog() {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logBuf.Flush()
+}
+
+func (s *Server) hdr(name string, rrtype uint16) dns.RR_Header {
+	// TTL 0 keeps resolvers from answering probes from cache
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 0}
+}
+
+func (s *Server) soa() dns.RR {
+	ns := "ns." + s.Zone
+	if len(s.NS) > 0 {
+		ns = s.NS[0]
+	}
+	return &dns.SOA{
+		Hdr:     s.hdr(s.Zone, dns.TypeSOA),
+		Ns:      ns,
+		Mbox:    "hostmaster." + s.Zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  0,
+	}
+}
+
+// echo builds the TXT strings answering an echo query: the query name and
+// source IP, signed if the server has a secret.
+func (s *Server) echo(name, src string) []string {
+	txt := []string{"name=" + name, "src=" + src}
+	if len(s.Secret) > 0 {
+		txt = append(txt, "sig="+signEcho(s.Secret, name, src))
+	}
+	return txt
+}
+
+// padTXT fills txt with filler strings until m packs to exactly size bytes,
+// or as close as the TXT encoding allows.
+func padTXT(m *dns.Msg, txt *dns.TXT, size int) {
+	for {
+		need := size - m.Len() - 1 // each string costs a length byte
+		if need < 0 {
+			return
+		}
+		txt.Txt = append(txt.Txt, strings.Repeat("x", min(need, 255)))
+		if need <= 255 {
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package scanner
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// readyPoll is how often waitSOCKS retries a tunnel client's SOCKS port.
+const readyPoll = 100 * time.Millisecond
+
+// maxTestBody bounds how much of the test URL's body is read and hashed.
+const maxTestBody = 16 << 20
+
+// proxyClient returns an HTTP client that goes through the local proxy of a
+// tunnel client on port, of the given kind. Redirects are not followed.
+func proxyClient(kind string, port int, user, pass string) (*http.Client, error) {
+	switch kind {
+	case ProxyHTTP:
+		u := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+		if user != "" {
+			u.User = url.UserPassword(user, pass)
+		}
+		return fetchClient(&http.Transport{Proxy: http.ProxyURL(u), DisableKeepAlives: true}), nil
+	case ProxyNone:
+		return nil, fmt.Errorf("tunnel client has no local proxy")
+	}
+	return socksClient(port, user, pass)
+}
+
+// socksClient returns an HTTP client that connects through the tunnel
+// client's SOCKS5 proxy on port. Host names are resolved by the proxy, so
+// the tunnel server does the lookups.
+func socksClient(port int, user, pass string) (*http.Client, error) {
+	return socksClientVia(fmt.Sprintf("127.0.0.1:%d", port), proxy.Direct, user, pass)
+}
+
+// socksClientVia is socksClient for a SOCKS5 proxy at addr reached through
+// forward, such as a stream of an embedded tunnel session.
+func socksClientVia(addr string, forward proxy.Dialer, user, pass string) (*http.Client, error) {
+	var auth *proxy.Auth
+	if user != "" {
+		auth = &proxy.Auth{User: user, Password: pass}
+	}
+	dialer, err := proxy.SOCKS5("tcp", addr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return fetchClient(&http.Transport{
+		DialContext:       dialer.(proxy.ContextDialer).DialContext,
+		DisableKeepAlives: true,
+	}), nil
+}
+
+// fetchClient returns a client using tr that, like curl without -L, does not
+// follow redirects.
+func fetchClient(tr *http.Transport) *http.Client {
+	return &http.Client{
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// testSOCKS fetches testURL with a client from proxyClient and requires a
+// 200 response. It records how long the connection through the tunnel took
+// to open, the TLS handshake for https URLs, the time to the first response
+// byte and a SHA-256 of the body, which tells a real page from a block page.
+func testSOCKS(ctx context.Context, client *http.Client, testURL string) (Metrics, error) {
+	// ConnectStart and ConnectDone only see the dial to the local proxy, so
+	// the connection is timed from GetConn until the SOCKS CONNECT is done,
+	// which is when TLS starts or, for plain http, when the conn is handed
+	// out.
+	var connStart, tlsStart time.Time
+	m := Metrics{}
+	connected := func() {
+		if _, ok := m["socks_connect_ms"]; !ok {
+			m["socks_connect_ms"] = msSince(connStart)
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { connStart = time.Now() },
+		TLSHandshakeStart: func() {
+			connected()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				m["tunnel_tls_ms"] = msSince(tlsStart)
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) { connected() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, testURL, nil)
+	if err != nil {
+		return nil, newFailure("socks", err)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, newFailure("socks", err)
+	}
+	defer resp.Body.Close()
+	m["ttfb_ms"] = msSince(start)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Failure{Stage: "socks", Class: ClassHTTPStatus, Err: "HTTP " + strconv.Itoa(resp.StatusCode)}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(resp.Body, maxTestBody)); err != nil {
+		return nil, newFailure("socks", err)
+	}
+	m["body_sha256"] = hex.EncodeToString(h.Sum(nil))
+	return m, nil
+}
+
+// waitSOCKS polls the SOCKS listener on port until a greeting is answered.
+// dnstt-client opens its listener before the session with the server is up
+// and accepts connections only after the handshake through the resolver, and
+// each accepted connection is relayed to the server, so an answer means
+// traffic flows through the tunnel.
+func waitSOCKS(ctx context.Context, port int) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for {
+		if socksGreet(ctx, addr) == nil {
+			return nil
+		}
+		select {
+		case <-time.After(readyPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// socksGreet offers the no-auth and username/password methods and reads the
+// method the proxy picks.
+func socksGreet(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	if _, err := conn.Write([]byte{5, 2, 0, 2}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("bad SOCKS version %d", reply[0])
+	}
+	return nil
+}
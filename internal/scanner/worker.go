@@ -1,55 +1,155 @@
 package scanner
 
 import (
+	"context"
+	"iter"
 	"math"
+	"net"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-type Metrics map[string]float64
+// Metrics holds a check's measurements. Values are mostly float64, plus a
+// few descriptive strings such as the transport used.
+type Metrics map[string]any
+
+// Float returns the numeric metric key, if present.
+func (m Metrics) Float(key string) (float64, bool) {
+	v, ok := m[key].(float64)
+	return v, ok
+}
+
+// DefaultPort is the resolver port used when the input does not give one.
+const DefaultPort = 53
+
+// Target is a resolver to scan: its IP and the port it serves DNS on. DoH
+// and DoT resolvers also carry their URL (https://... or tls://host:port),
+// and their IP may be a hostname.
+type Target struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Addr returns the target as host:port, bracketing IPv6 addresses.
+func (t Target) Addr() string {
+	return net.JoinHostPort(t.IP, strconv.Itoa(t.Port))
+}
+
+// String identifies the target: its URL if it has one, else host:port.
+func (t Target) String() string {
+	if t.URL != "" {
+		return t.URL
+	}
+	return t.Addr()
+}
+
+// Network returns "doh" or "dot" for encrypted resolvers, else "".
+func (t Target) Network() string {
+	switch {
+	case strings.HasPrefix(t.URL, "https://"):
+		return "doh"
+	case strings.HasPrefix(t.URL, "tls://"):
+		return "dot"
+	}
+	return ""
+}
 
 type Result struct {
-	IP      string
-	OK      bool
-	Metrics Metrics
+	Target
+	OK      bool     `json:"ok"`
+	Metrics Metrics  `json:"metrics,omitempty"`
+	Failure *Failure `json:"failure,omitempty"`
+}
+
+// CheckFunc tests a single target. A nil error means the IP passed; failures are
+// reported as a *Failure describing the cause. Implementations must return
+// promptly once ctx is cancelled and must not leave child processes running.
+type CheckFunc func(ctx context.Context, t Target, timeout time.Duration) (Metrics, error)
+
+// Targets is a sequence of resolvers to scan whose length is known up front, so
+// large inputs can be expanded lazily while the pool consumes them.
+type Targets interface {
+	Len() int
+	All() iter.Seq[Target]
 }
 
-type CheckFunc func(ip string, timeout time.Duration) (bool, Metrics)
+// TargetList is a Targets backed by a slice.
+type TargetList []Target
+
+func (l TargetList) Len() int              { return len(l) }
+func (l TargetList) All() iter.Seq[Target] { return slices.Values(l) }
 
 type ProgressFunc func(done, total, passed, failed int)
 
-func RunPool(ips []string, workers int, timeout time.Duration, check CheckFunc, onProgress ProgressFunc) []Result {
-	jobs := make(chan string)
+// ResultFunc receives each result as soon as its check completes.
+type ResultFunc func(r Result)
+
+// RunPool runs check against every IP using the given number of workers. When
+// ctx is cancelled no new IPs are dispatched and the results gathered so far
+// are returned. Failures reported by checks that were interrupted are dropped,
+// since they say nothing about the resolver.
+//
+// If onResult is non-nil, results are handed to it as they arrive instead of
+// being collected, and RunPool returns nil.
+func RunPool(ctx context.Context, ips Targets, workers int, timeout time.Duration, check CheckFunc, onProgress ProgressFunc, onResult ResultFunc) []Result {
+	jobs := make(chan Target)
 	results := make(chan Result)
 
+	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
+		wg.Add(1)
 		go func() {
-			for ip := range jobs {
-				ok, m := check(ip, timeout)
-				results <- Result{IP: ip, OK: ok, Metrics: m}
+			defer wg.Done()
+			for t := range jobs {
+				m, err := check(ctx, t, timeout)
+				if err != nil && ctx.Err() != nil {
+					continue
+				}
+				r := Result{Target: t, OK: err == nil, Metrics: m}
+				if err != nil {
+					r.Failure = newFailure("check", err)
+				}
+				results <- r
 			}
 		}()
 	}
 
 	go func() {
-		for _, ip := range ips {
-			jobs <- ip
+		defer close(jobs)
+		for t := range ips.All() {
+			select {
+			case jobs <- t:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
 	}()
 
 	var pass, fail int
-	out := make([]Result, 0, len(ips))
-	for i := 0; i < len(ips); i++ {
-		r := <-results
-		out = append(out, r)
+	var out []Result
+	for r := range results {
+		if onResult != nil {
+			onResult(r)
+		} else {
+			out = append(out, r)
+		}
 		if r.OK {
 			pass++
 		} else {
 			fail++
 		}
 		if onProgress != nil {
-			onProgress(i+1, len(ips), pass, fail)
+			onProgress(pass+fail, ips.Len(), pass, fail)
 		}
 	}
 	return out
@@ -59,15 +159,33 @@ func roundMs(v float64) float64 {
 	return math.Round(v*1000) / 1000
 }
 
+// msSince returns the milliseconds elapsed since t, rounded like roundMs.
+func msSince(t time.Time) float64 {
+	return roundMs(float64(time.Since(t).Microseconds()) / 1000.0)
+}
+
+// SortByMetric sorts results by the numeric metric key, ascending, or
+// descending if key starts with "-". Results without the metric go last.
 func SortByMetric(results []Result, key string) {
-	sort.SliceStable(results, func(i, j int) bool {
-		vi, oki := results[i].Metrics[key]
-		vj, okj := results[j].Metrics[key]
-		if !oki {
-			vi = math.MaxFloat64
+	sortByMetric(results, key, func(r Result) Metrics { return r.Metrics })
+}
+
+// SortRecords is SortByMetric for records.
+func SortRecords(recs []IPRecord, key string) {
+	sortByMetric(recs, key, func(r IPRecord) Metrics { return r.Metrics })
+}
+
+func sortByMetric[T any](s []T, key string, metrics func(T) Metrics) {
+	desc := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+	sort.SliceStable(s, func(i, j int) bool {
+		vi, oki := metrics(s[i]).Float(key)
+		vj, okj := metrics(s[j]).Float(key)
+		if oki != okj {
+			return oki
 		}
-		if !okj {
-			vj = math.MaxFloat64
+		if desc {
+			return vi > vj
 		}
 		return vi < vj
 	})